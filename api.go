@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"rsr/recorder"
+)
+
+var errForbiddenSink = errors.New("stations added through the API may not use 'pipe' sinks")
+
+// The HTTP API for watching and controlling the stations being recorded
+// (see `usage()` for the endpoints).
+type apiServer struct {
+	m     *stationManager
+	dir   string // Output directory, which added stations must stay inside.
+	token string // Required bearer token, if set.
+}
+
+// A station as described by the API.
+type stationStatus struct {
+	Name string `json:"name"`
+	recorder.Status
+}
+
+func newStationStatus(s *runningStation) stationStatus {
+	return stationStatus{Name: s.name, Status: s.rec.Status()}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Responds with "Method Not Allowed", unless the request's method is one of
+// `allowed`.
+func allowMethods(w http.ResponseWriter, r *http.Request, allowed ...string) bool {
+	for _, m := range allowed {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+	return false
+}
+
+func (a *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.token != "" {
+		auth := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(auth, []byte("Bearer "+a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("invalid or missing token"))
+			return
+		}
+	}
+
+	// Routes: /metrics, /stations, /stations/<NAME> and
+	// /stations/<NAME>/<ACTION>.
+	var segs []string
+	for _, seg := range strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/") {
+		seg, err := url.PathUnescape(seg)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		segs = append(segs, seg)
+	}
+	if len(segs) == 1 && segs[0] == "metrics" {
+		a.serveMetrics(w, r)
+		return
+	}
+	if segs[0] != "stations" {
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	switch len(segs) {
+	case 1:
+		a.serveStations(w, r)
+	case 2:
+		a.serveStation(w, r, segs[1])
+	case 3:
+		a.serveAction(w, r, segs[1], segs[2])
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// Lists or adds stations.
+func (a *apiServer) serveStations(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET", "POST") {
+		return
+	}
+	if r.Method == "GET" {
+		ret := []stationStatus{}
+		for _, s := range a.m.list() {
+			ret = append(ret, newStationStatus(s))
+		}
+		writeJSON(w, http.StatusOK, ret)
+		return
+	}
+
+	var cfg stationConfig
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid station: %w", err))
+		return
+	}
+	if err := a.checkStation(&cfg); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s, err := a.m.add(cfg)
+	switch {
+	case errors.Is(err, errDuplicateStation):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, errShuttingDown):
+		writeError(w, http.StatusServiceUnavailable, err)
+	case err != nil:
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		w.Header().Set("Location", "/stations/"+url.PathEscape(s.name))
+		writeJSON(w, http.StatusCreated, newStationStatus(s))
+	}
+}
+
+// Checks a station added through the API, and creates its directory inside
+// the output directory. As with the stations file, unset options default
+// to the command line options.
+func (a *apiServer) checkStation(cfg *stationConfig) error {
+	if cfg.Name == "" || cfg.URL == "" {
+		return errors.New("a station needs a \"name\" and a \"url\"")
+	}
+	for _, spec := range cfg.Sinks {
+		if strings.HasPrefix(spec, "pipe:") {
+			return errForbiddenSink
+		}
+	}
+	dir := filepath.Clean(cfg.Dir)
+	if filepath.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("directory must be inside the output directory: '%v'", cfg.Dir)
+	}
+	cfg.Dir = filepath.Join(a.dir, dir)
+	if err := os.MkdirAll(cfg.Dir, 0777); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Shows or removes a station.
+func (a *apiServer) serveStation(w http.ResponseWriter, r *http.Request, name string) {
+	if !allowMethods(w, r, "GET", "DELETE") {
+		return
+	}
+	s := a.m.find(name)
+	if s == nil {
+		writeError(w, http.StatusNotFound, errUnknownStation)
+		return
+	}
+	if r.Method == "GET" {
+		writeJSON(w, http.StatusOK, newStationStatus(s))
+		return
+	}
+	if err := a.m.remove(name); err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Pauses, resumes, splits or skips.
+func (a *apiServer) serveAction(w http.ResponseWriter, r *http.Request, name, action string) {
+	s := a.m.find(name)
+	if s == nil {
+		writeError(w, http.StatusNotFound, errUnknownStation)
+		return
+	}
+	switch action {
+	case "pause", "resume", "split", "skip":
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+	if !allowMethods(w, r, "POST") {
+		return
+	}
+	var err error
+	switch action {
+	case "pause":
+		s.rec.Pause()
+	case "resume":
+		s.rec.Resume()
+	case "split":
+		err = s.rec.Split()
+	case "skip":
+		err = s.rec.Skip()
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, newStationStatus(s))
+}
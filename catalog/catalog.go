@@ -0,0 +1,116 @@
+// Persistent catalog of recorded tracks. The catalog is stored as a JSON-lines
+// file in the output directory, with one entry appended for every saved track.
+// Later entries for the same artist/title pair supersede earlier ones.
+package catalog
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name of the catalog file within the output directory.
+const Filename = ".rsr-catalog.jsonl"
+
+type Entry struct {
+	Artist   string `json:"artist"`
+	Title    string `json:"title"`
+	Filename string `json:"filename"`
+	Size     int    `json:"size"` // Size in bytes.
+	// Duration in seconds, without any padding around the track. Missing in
+	// entries written by older versions.
+	Duration float64   `json:"duration,omitempty"`
+	Recorded time.Time `json:"recorded"`
+}
+
+type Catalog struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]Entry
+}
+
+// Returns the key identifying an artist/title pair, ignoring capitalization
+// and surrounding whitespace.
+func key(artist, title string) string {
+	return strings.ToLower(strings.TrimSpace(artist)) + "\x00" +
+		strings.ToLower(strings.TrimSpace(title))
+}
+
+// Opens the catalog in directory `dir`, reading all existing entries. The
+// catalog file is created once the first entry is added.
+func Open(dir string) (*Catalog, error) {
+	c := &Catalog{
+		path:    path.Join(dir, Filename),
+		entries: make(map[string]Entry),
+	}
+
+	f, err := os.Open(c.path)
+	if os.IsNotExist(err) {
+		return c, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var e Entry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%v: line %v: %w", c.path, lineNum, err)
+		}
+		c.entries[key(e.Artist, e.Title)] = e
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Catalog) Path() string {
+	return c.path
+}
+
+// Looks up the entry for an artist/title pair. Tracks without a title are
+// never found, as they can't be told apart.
+func (c *Catalog) Lookup(artist, title string) (e Entry, found bool) {
+	if title == "" {
+		return Entry{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found = c.entries[key(artist, title)]
+	return e, found
+}
+
+// Adds an entry, appending it to the catalog file.
+func (c *Catalog) Add(e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, err := os.OpenFile(c.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	if e.Title != "" {
+		c.entries[key(e.Artist, e.Title)] = e
+	}
+	return nil
+}
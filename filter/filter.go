@@ -0,0 +1,217 @@
+// Include/exclude rules deciding which tracks are saved.
+//
+// A rule consists of an action ("include" or "exclude"), a field and a
+// regular expression. The field can be "artist", "title", "streamtitle" (the
+// raw ICY stream title) or the name of any Vorbis comment field. Field names
+// are case insensitive.
+//
+// A track is saved if it matches none of the exclude rules and, if there are
+// any include rules at all, at least one of the include rules.
+package filter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"rsr/model"
+)
+
+var (
+	ErrInvalidAction = errors.New("filter: action must be 'include' or 'exclude'")
+	ErrInvalidRule   = errors.New("filter: expected '<include|exclude> <FIELD> <REGEXP>'")
+)
+
+type Action int
+
+const (
+	Include Action = iota
+	Exclude
+)
+
+func (a Action) String() string {
+	if a == Include {
+		return "include"
+	}
+	return "exclude"
+}
+
+type Rule struct {
+	Action Action
+	Field  string
+	Re     *regexp.Regexp
+}
+
+// Creates a rule from its action, field and regular expression.
+func NewRule(action Action, field, expr string) (Rule, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return Rule{}, err
+	}
+	return Rule{
+		Action: action,
+		Field:  strings.ToLower(field),
+		Re:     re,
+	}, nil
+}
+
+// Parses a rule in the command line format "<FIELD>=<REGEXP>".
+func ParseRule(action Action, s string) (Rule, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return Rule{}, fmt.Errorf("filter: expected '<FIELD>=<REGEXP>', but got '%v'", s)
+	}
+	return NewRule(action, s[:i], s[i+1:])
+}
+
+// Returns the value of the field the rule applies to.
+func (r Rule) value(m model.Metadata) (string, bool) {
+	switch r.Field {
+	case "artist":
+		return m.Artist, m.Artist != ""
+	case "title":
+		return m.Title, m.Title != ""
+	}
+	return m.Field(r.Field)
+}
+
+func (r Rule) Matches(m model.Metadata) bool {
+	v, ok := r.value(m)
+	return ok && r.Re.MatchString(v)
+}
+
+func (r Rule) String() string {
+	return r.Action.String() + " " + r.Field + " " + r.Re.String()
+}
+
+type Rules []Rule
+
+// Parses a rules file. Each non-empty line not starting with '#' holds one
+// rule in the format "<include|exclude> <FIELD> <REGEXP>", where the regular
+// expression extends until the end of the line.
+func Parse(r io.Reader) (Rules, error) {
+	var ret Rules
+	sc := bufio.NewScanner(r)
+	for lineNum := 1; sc.Scan(); lineNum++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		s := strings.Fields(line)
+		if len(s) < 3 {
+			return nil, fmt.Errorf("line %v: %w", lineNum, ErrInvalidRule)
+		}
+		var action Action
+		switch strings.ToLower(s[0]) {
+		case "include":
+			action = Include
+		case "exclude":
+			action = Exclude
+		default:
+			return nil, fmt.Errorf("line %v: %w", lineNum, ErrInvalidAction)
+		}
+		// Everything after the field name is the regular expression, so it
+		// may contain spaces.
+		expr := strings.TrimSpace(line[len(s[0]):])
+		expr = strings.TrimSpace(expr[len(s[1]):])
+
+		rule, err := NewRule(action, s[1], expr)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", lineNum, err)
+		}
+		ret = append(ret, rule)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// Decides whether a track with the given metadata should be saved. If not,
+// `reason` describes the rule responsible.
+func (rs Rules) Match(m model.Metadata) (save bool, reason string) {
+	hasInclude := false
+	included := false
+	for _, r := range rs {
+		switch r.Action {
+		case Exclude:
+			if r.Matches(m) {
+				return false, "matches '" + r.String() + "'"
+			}
+		case Include:
+			hasInclude = true
+			if !included && r.Matches(m) {
+				included = true
+			}
+		}
+	}
+	if hasInclude && !included {
+		return false, "matches no include rule"
+	}
+	return true, ""
+}
+
+// A rules file, which is reloaded whenever it is modified. It is safe for
+// concurrent use.
+type File struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	rules   Rules
+}
+
+// Loads the rules file at `path`.
+func OpenFile(path string) (*File, error) {
+	f := &File{path: path}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) Path() string {
+	return f.path
+}
+
+// Reloads the file if it was modified since it was last read.
+func (f *File) reload() (reloaded bool, err error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	if info.ModTime().Equal(f.modTime) {
+		return false, nil
+	}
+	// Remember the modification time even if parsing fails, so a broken file
+	// is only reported once.
+	f.modTime = info.ModTime()
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	rules, err := Parse(file)
+	if err != nil {
+		return false, fmt.Errorf("%v: %w", f.path, err)
+	}
+	f.rules = rules
+	return true, nil
+}
+
+// Returns the current rules, reloading the file first if it has changed.
+// If reloading fails, the previously loaded rules are returned together with
+// the error.
+func (f *File) Rules() (rules Rules, reloaded bool, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reloaded, err = f.reload()
+	return f.rules, reloaded, err
+}
@@ -0,0 +1,55 @@
+// Append-only logs of every title seen on a station, whether it was saved or
+// not. Logs are stored as JSON-lines files with one entry whenever a title
+// appears, changes or is dropped, and one for what happened to each track.
+package history
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Extension of history logs.
+const Ext = ".history.jsonl"
+
+// Kinds of entries.
+const (
+	Title   = "title"   // A new title appeared.
+	Update  = "update"  // Other metadata of the current title changed.
+	Dropped = "dropped" // A new title didn't persist for the debounce time.
+	Result  = "result"  // The track of a title was saved or discarded.
+)
+
+type Entry struct {
+	// When the title appeared, changed or was dropped, or when its track
+	// was done.
+	Time        time.Time `json:"time"`
+	Kind        string    `json:"kind"`
+	Station     string    `json:"station,omitempty"`
+	Artist      string    `json:"artist,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	RawMetadata string    `json:"raw_metadata,omitempty"`
+	// Only set on results.
+	Saved    bool   `json:"saved,omitempty"`
+	Filename string `json:"filename,omitempty"` // Where the title was saved.
+	// Why the title wasn't saved, or why it was saved as a partial track.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Appends an entry to the log at `path`, creating the log if needed.
+func Append(path string, e Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
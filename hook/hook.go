@@ -0,0 +1,216 @@
+// Running external commands when something happens to a station or its
+// tracks, e.g. to post-process saved tracks.
+//
+// Commands are run by the shell ("sh -c", or "cmd /C" on Windows), with
+// everything known about the event in environment variables:
+//
+//	RSR_EVENT     Event type, e.g. "track_saved" (see `recorder.EventType`).
+//	RSR_STATION   Station name.
+//	RSR_FILE      Path of the saved track on the local file system, if any.
+//	RSR_FILENAME  Filename of the track.
+//	RSR_ARTIST, RSR_TITLE, RSR_ALBUM
+//	RSR_DURATION  Duration of the track in seconds.
+//	RSR_SIZE      Size of the track in bytes.
+//	RSR_REASON    Why the track was discarded or is partial.
+//	RSR_ERROR     Why saving the track failed or the connection was lost.
+package hook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rsr/recorder"
+)
+
+// Defaults of `Runner`.
+const (
+	DefaultLimit   = 2
+	DefaultTimeout = 10 * time.Minute
+)
+
+// Output of a command logged at most, in bytes. Anything before is dropped.
+const maxOutput = 16 * 1024
+
+// Commands to run, empty for none.
+type Hooks struct {
+	OnSave       string // A track or show was saved.
+	OnDiscard    string // A track was discarded, or saving it failed.
+	OnConnect    string
+	OnDisconnect string // The connection was lost.
+}
+
+// Returns the name and command of the hook for an event, if there is one.
+func (h Hooks) lookup(t recorder.EventType) (name, command string) {
+	switch t {
+	case recorder.TrackSaved:
+		return "on-save", h.OnSave
+	case recorder.TrackDiscarded, recorder.TrackFailed:
+		return "on-discard", h.OnDiscard
+	case recorder.Connected:
+		return "on-connect", h.OnConnect
+	case recorder.Disconnected:
+		return "on-disconnect", h.OnDisconnect
+	}
+	return "", ""
+}
+
+// Receives the output of commands and why they failed.
+type Logger interface {
+	Infof(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// Runs hooks in the background, at most `Limit` at a time. Hooks waiting for
+// their turn run in the order of their events.
+type Runner struct {
+	Hooks   Hooks
+	Limit   int           // Default: DefaultLimit.
+	Timeout time.Duration // Time after which commands are killed (default: DefaultTimeout).
+
+	once  sync.Once
+	queue chan job
+	wg    sync.WaitGroup
+}
+
+type job struct {
+	name, command string
+	env           []string
+	log           Logger
+}
+
+func (r *Runner) start() {
+	if r.Limit <= 0 {
+		r.Limit = DefaultLimit
+	}
+	if r.Timeout <= 0 {
+		r.Timeout = DefaultTimeout
+	}
+	r.queue = make(chan job, 1024)
+	for i := 0; i < r.Limit; i++ {
+		go func() {
+			for j := range r.queue {
+				r.run(j)
+				r.wg.Done()
+			}
+		}()
+	}
+}
+
+// Runs the hook for the event, if there is one, logging to `log`. Doesn't
+// wait for the command, unless too many are waiting to run already.
+func (r *Runner) Handle(e recorder.Event, log Logger) {
+	name, command := r.Hooks.lookup(e.Type)
+	if command == "" {
+		return
+	}
+	r.once.Do(r.start)
+	r.wg.Add(1)
+	r.queue <- job{name: name, command: command, env: Env(e), log: log}
+}
+
+// Waits for all hooks to finish.
+func (r *Runner) Wait() {
+	r.wg.Wait()
+}
+
+func (r *Runner) run(j job) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", j.command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", j.command)
+	}
+	cmd.Env = append(os.Environ(), j.env...)
+	// Capture the output in a file rather than a pipe, since processes
+	// started by the command may keep a pipe open after it was killed.
+	out, err := os.CreateTemp("", "rsr-hook-*")
+	if err != nil {
+		j.log.Errorf("Error running hook %v: %v", j.name, err)
+		return
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+	cmd.Stdout, cmd.Stderr = out, out
+
+	err = cmd.Run()
+	for _, line := range readOutput(out) {
+		j.log.Infof("Hook %v: %v", j.name, line)
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		j.log.Errorf("Hook %v timed out after %v", j.name, r.Timeout)
+	case err != nil:
+		j.log.Errorf("Hook %v failed: %v", j.name, err)
+	}
+}
+
+// Returns the last lines of the output, without empty ones.
+func readOutput(f *os.File) []string {
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil
+	}
+	start := size - maxOutput
+	if start < 0 {
+		start = 0
+	}
+	data := make([]byte, size-start)
+	if _, err := f.ReadAt(data, start); err != nil && err != io.EOF {
+		return nil
+	}
+	if start > 0 {
+		// Drop the partial first line.
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			data = data[i+1:]
+		}
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// Returns the environment variables describing an event.
+func Env(e recorder.Event) []string {
+	file := e.Path
+	if abs, err := filepath.Abs(file); err == nil && file != "" {
+		file = abs
+	}
+	env := []string{
+		"RSR_EVENT=" + e.Type.String(),
+		"RSR_STATION=" + e.Station,
+		"RSR_FILE=" + file,
+		"RSR_FILENAME=" + e.Filename,
+		"RSR_ARTIST=" + e.Metadata.Artist,
+		"RSR_TITLE=" + e.Metadata.Title,
+		"RSR_ALBUM=" + e.Metadata.Album,
+		"RSR_REASON=" + e.Reason,
+	}
+	if e.Filename != "" {
+		env = append(env,
+			fmt.Sprintf("RSR_DURATION=%.3f", e.Duration.Seconds()),
+			"RSR_SIZE="+strconv.Itoa(e.Size))
+	}
+	if e.Err != nil {
+		env = append(env, "RSR_ERROR="+e.Err.Error())
+	}
+	return env
+}
@@ -0,0 +1,228 @@
+// Leveled logging with fields (e.g. the station and track a message is
+// about), written as human readable text or as JSON lines.
+//
+// Text lines look like "* [<STATION>] <MESSAGE>", starting with '-' for debug
+// messages, '*' for info, '!' for warnings and '!!' for errors. Fields other
+// than the station are only included in JSON lines, which look like
+//
+//	{"time":"<RFC 3339>","level":"info","msg":"<MESSAGE>","station":"<STATION>",...}
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// Parses "debug", "info", "warn" or "error".
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return Debug, nil
+	case "info":
+		return Info, nil
+	case "warn", "warning":
+		return Warn, nil
+	case "error":
+		return Error, nil
+	}
+	return 0, fmt.Errorf("invalid log level '%v', expected debug, info, warn or error", s)
+}
+
+type Format int
+
+const (
+	Text Format = iota
+	JSON
+)
+
+// Parses "text" or "json".
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text":
+		return Text, nil
+	case "json":
+		return JSON, nil
+	}
+	return 0, fmt.Errorf("invalid log format '%v', expected text or json", s)
+}
+
+const (
+	colRed    = "\033[31m"
+	colYellow = "\033[33m"
+	colReset  = "\033[m"
+)
+
+// Reports whether colors should be used on `f`: Only if it's a terminal and
+// NO_COLOR (see no-color.org) isn't set.
+func ColorTerminal(f *os.File) bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+type Options struct {
+	Level  Level // Messages below are dropped. Default: Debug.
+	Format Format
+	// Where messages go. Warnings and errors go to `ErrOutput` instead, if
+	// set.
+	Output    io.Writer
+	ErrOutput io.Writer
+	// Color warnings and errors in text lines written to `Output` or
+	// `ErrOutput`, respectively.
+	Color, ErrColor bool
+	// Start text lines with the time, e.g. for log files.
+	Timestamps bool
+}
+
+// Output shared by a logger and all loggers derived from it through `With()`.
+type output struct {
+	Options
+	mu sync.Mutex
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Safe for concurrent use.
+type Logger struct {
+	out    *output
+	fields []field
+}
+
+func New(opts Options) *Logger {
+	if opts.Output == nil {
+		opts.Output = io.Discard
+	}
+	return &Logger{out: &output{Options: opts}}
+}
+
+// Returns a logger adding a field to all messages, replacing the field's
+// previous value. A field named "station" is also shown in text lines.
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]field, 0, len(l.fields)+1)
+	for _, f := range l.fields {
+		if f.key != key {
+			fields = append(fields, f)
+		}
+	}
+	return &Logger{out: l.out, fields: append(fields, field{key, value})}
+}
+
+// Reports whether messages of the level are logged.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.out.Level
+}
+
+func (l *Logger) Debugf(f string, v ...interface{}) { l.Logf(Debug, f, v...) }
+func (l *Logger) Infof(f string, v ...interface{})  { l.Logf(Info, f, v...) }
+func (l *Logger) Warnf(f string, v ...interface{})  { l.Logf(Warn, f, v...) }
+func (l *Logger) Errorf(f string, v ...interface{}) { l.Logf(Error, f, v...) }
+
+func (l *Logger) Logf(level Level, f string, v ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(f, v...)
+	w, color := l.out.Output, l.out.Color
+	if level >= Warn && l.out.ErrOutput != nil {
+		w, color = l.out.ErrOutput, l.out.ErrColor
+	}
+	var line []byte
+	if l.out.Format == JSON {
+		line = l.jsonLine(time.Now(), level, msg)
+	} else {
+		line = l.textLine(time.Now(), level, msg, color)
+	}
+
+	l.out.mu.Lock()
+	w.Write(line)
+	l.out.mu.Unlock()
+}
+
+func (l *Logger) textLine(t time.Time, level Level, msg string, useColor bool) []byte {
+	var b strings.Builder
+	if l.out.Timestamps {
+		b.WriteString(t.Format("2006-01-02 15:04:05 "))
+	}
+	color := ""
+	if useColor {
+		switch level {
+		case Warn:
+			color = colYellow
+		case Error:
+			color = colRed
+		}
+	}
+	b.WriteString(color)
+	switch level {
+	case Debug:
+		b.WriteString("- ")
+	case Info:
+		b.WriteString("* ")
+	case Warn:
+		b.WriteString("! ")
+	default:
+		b.WriteString("!! ")
+	}
+	for _, f := range l.fields {
+		if f.key == "station" {
+			fmt.Fprintf(&b, "[%v] ", f.value)
+		}
+	}
+	b.WriteString(msg)
+	if color != "" {
+		b.WriteString(colReset)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func (l *Logger) jsonLine(t time.Time, level Level, msg string) []byte {
+	var b strings.Builder
+	writeField := func(key string, value interface{}) {
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		b.WriteByte(',')
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	fmt.Fprintf(&b, `{"time":"%v"`, t.Format(time.RFC3339Nano))
+	writeField("level", level.String())
+	writeField("msg", msg)
+	for _, f := range l.fields {
+		writeField(f.key, f.value)
+	}
+	b.WriteString("}\n")
+	return []byte(b.String())
+}
@@ -0,0 +1,110 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Defaults of `RotatingFile`.
+const (
+	DefaultMaxSize  = 10 << 20
+	DefaultMaxFiles = 5
+)
+
+// A log file that is rotated once it grows larger than `MaxSize`: The file is
+// renamed to "<PATH>.1", the previous "<PATH>.1" to "<PATH>.2" and so on,
+// keeping at most `MaxFiles` old files.
+type RotatingFile struct {
+	Path     string
+	MaxSize  int64 // Default: `DefaultMaxSize`.
+	MaxFiles int   // Default: `DefaultMaxFiles`.
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// Opens the log file, appending to it if it exists.
+func OpenRotatingFile(path string, maxSize int64, maxFiles int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxFiles
+	}
+	r := &RotatingFile{Path: path, MaxSize: maxSize, MaxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// Writes `p`, rotating the file first if `p` doesn't fit anymore. Lines are
+// never split between files.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.MaxSize {
+		if err := r.rotate(); err != nil {
+			// Keep logging to the file we have.
+			fmt.Fprintf(os.Stderr, "Error rotating log file: %v\n", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+	for i := r.MaxFiles - 1; i >= 1; i-- {
+		old := fmt.Sprintf("%v.%v", r.Path, i)
+		if err := os.Rename(old, fmt.Sprintf("%v.%v", r.Path, i+1)); err != nil && !os.IsNotExist(err) {
+			return r.reopen(err)
+		}
+	}
+	if err := os.Rename(r.Path, r.Path+".1"); err != nil {
+		return r.reopen(err)
+	}
+	return r.open()
+}
+
+// Reopens the file after rotating it failed.
+func (r *RotatingFile) reopen(err error) error {
+	if openErr := r.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -1,178 +1,443 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
-	"path"
+	"os/signal"
 	"strconv"
-
-	"rsr/model"
-	"rsr/mp3"
-	"rsr/util"
-	"rsr/vorbis"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"rsr/catalog"
+	"rsr/filter"
+	"rsr/history"
+	"rsr/hook"
+	"rsr/logging"
+	"rsr/recorder"
+	"rsr/sidecar"
+	"rsr/sink"
+	"rsr/storage"
+	"rsr/webhook"
 )
 
 var client = new(http.Client)
 
-const (
-	colRed    = "\033[31m"
-	colYellow = "\033[33m"
-	colReset  = "\033[m"
-)
-
 var (
-	nTracksRecorded int // Number of recorded tracks.
-	limitTracks     bool
-	maxTracks       int
+	nTracksRecordedMu sync.Mutex
+	nTracksRecorded   int // Number of recorded tracks.
+	limitTracks       bool
+	maxTracks         int
+	stopRecording     context.CancelFunc // Stops all stations once `maxTracks` are recorded.
+
+	filterRules filter.Rules // Rules given on the command line.
+	filterFile  *filter.File // Rules file given on the command line (optional).
+
+	skipExisting     bool // Don't record tracks that are already in the archive.
+	rerecordIfLonger bool // Record known tracks, but only replace them with longer takes.
+
+	writeSidecars  bool // Write a JSON sidecar file for every saved track.
+	writePlaylists bool // Keep an M3U playlist of the saved tracks per day.
+	writeHistory   bool // Log every title seen, whether it was saved or not.
+
+	titleDebounce time.Duration // Minimum time a new ICY title has to persist.
+
+	// Splitting by time when there is no usable metadata.
+	splitEvery    time.Duration // Length of time based tracks.
+	fallbackAfter time.Duration // Time a title may stay unchanged (0 for unlimited).
+
+	// Whether to save tracks interrupted by a lost connection (as partial
+	// tracks) instead of discarding them.
+	saveInterrupted bool
+
+	keepFirst        bool                            // Save the first and last track, marked as partial.
+	partialSuffix    = recorder.DefaultPartialSuffix // Inserted before the extension of partial tracks.
+	tagPartialTracks bool                            // Add a "PARTIAL=1" tag to partial tracks.
+
+	// Padding added before the start and after the end of each track.
+	preRoll, postRoll time.Duration
+
+	scheduleRules []string           // Weekly recording windows (empty to record continuously).
+	scheduleLead  = 30 * time.Second // Time to connect before a recording window.
+
+	showTemplate = recorder.DefaultShowTemplate // Filename template of show recordings.
+
+	archiveLength   time.Duration                     // Length of archive segments (0 to not archive).
+	archiveTemplate = recorder.DefaultArchiveTemplate // Filename template of archive segments.
+
+	maxReconnects int // Failed attempts to reconnect before giving up (0 for unlimited).
+
+	sinkSpecs []string // Where to save tracks, see `sink.Parse()`.
+
+	minFree        uint64            // Free space needed for saving, in bytes (0 to not check).
+	stopOnLowSpace bool              // Stop instead of pausing when the disk is low on space.
+	retention      storage.Retention // Limits on the recordings kept.
+
+	hooks hook.Runner // Commands run on events.
+
+	webhookURLs   []string
+	webhookEvents []recorder.EventType // Default: webhook.DefaultEvents.
+	webhooks      []*webhook.Webhook
+
+	// Until the logging options are parsed, messages go to the terminal.
+	logger = logging.New(logging.Options{
+		Level:     logging.Info,
+		Output:    os.Stdout,
+		ErrOutput: os.Stderr,
+		Color:     logging.ColorTerminal(os.Stdout),
+		ErrColor:  logging.ColorTerminal(os.Stderr),
+	})
 )
 
+// Time to wait for queued webhook requests when exiting.
+const webhookFlushTimeout = 10 * time.Second
+
 func usage(arg0 string, exitStatus int) {
 	fmt.Fprintln(os.Stderr, `Usage:
   `+arg0+` [options...] <STREAM_URL>
+  `+arg0+` [options...] -stations <FILE>
 
 Options:
   -dir <DIRECTORY>  --  Output directory (default: ".").
   -n <NUM>          --  Stop after <NUM> tracks.
+  -stations <FILE>  --  Record all stations listed in the JSON file <FILE>
+                        (see below).
+  -schedule <RULE>  --  Only record during the weekly recording window
+                        <RULE> (see below); may be given multiple times.
+                        Applies to stations without a "schedule".
+  -lead <SECONDS>   --  Connect <SECONDS> before a recording window starts
+                        (default: 30).
+  -duration <DURATION>
+                    --  Stop recording after <DURATION> (e.g. '1h30m').
+  -until <TIME>     --  Stop recording at <TIME> ('15:04',
+                        '2006-01-02 15:04' or RFC 3339).
+  -include <FIELD>=<REGEXP>
+                    --  Only save tracks whose <FIELD> matches <REGEXP>.
+  -exclude <FIELD>=<REGEXP>
+                    --  Don't save tracks whose <FIELD> matches <REGEXP>.
+  -filter <FILE>    --  Read include/exclude rules from <FILE>, one
+                        '<include|exclude> <FIELD> <REGEXP>' per line. The
+                        file is reloaded automatically when it changes.
+  -skip-existing    --  Don't record tracks that were already recorded (as
+                        listed in the catalog file '`+catalog.Filename+`' in
+                        the output directory, or present as a file). Every
+                        saved track is added to the catalog, which is only
+                        kept with this option or '-rerecord-if-longer'.
+  -rerecord-if-longer
+                    --  Record tracks that were already recorded again, but
+                        only replace them if the new take is longer, not
+                        counting pre-roll and post-roll.
+  -debounce <SECONDS>
+                    --  Only split mp3 streams when a new title persists
+                        for at least <SECONDS> (default: 0).
+  -split-every <DURATION>
+                    --  Split streams without metadata, or without a title
+                        for <DURATION> after connecting, into tracks of
+                        <DURATION> (e.g. '30m'), cut on frame or page
+                        boundaries and named after the station and time
+                        (default: the -fallback-after time, or 30m).
+  -fallback-after <DURATION>
+                    --  Also split by time while the title doesn't change
+                        for <DURATION>, until it changes again.
+  -interrupted <save|discard>
+                    --  What to do with a track interrupted by a lost
+                        connection, if the stream doesn't resume with the
+                        same track after reconnecting. Saved tracks are
+                        marked as partial (default: discard).
+  -keep-first       --  Save the first track after connecting and the
+                        track being recorded when stopping instead of
+                        discarding them, marked as partial.
+  -partial-suffix <SUFFIX>
+                    --  Inserted before the file extension of partial
+                        tracks; may be empty (default: ".partial").
+  -partial-tag      --  Mark partial tracks with a 'PARTIAL=1' Vorbis
+                        comment or ID3 tag.
+  -pre-roll <SECONDS>
+                    --  Include <SECONDS> from before each track's start.
+  -post-roll <SECONDS>
+                    --  Include <SECONDS> from after each track's end. The
+                        next track still starts at its own beginning. Ogg
+                        tracks get neither, as each starts a new stream.
+  -sidecar          --  Write a JSON file with all known metadata next to
+                        each saved track ('<TRACK>`+sidecar.Ext+`').
+  -playlist         --  Keep an M3U playlist of the tracks saved each day
+                        ('<STATION> <DATE>.m3u8').
+  -history          --  Log every title as it appears, changes or is dropped
+                        by -debounce, and whether and where its track was
+                        saved or why not ('<STATION>`+history.Ext+`').
+  -show <NAME>      --  Record the show <NAME>: save each recording window
+                        (or the whole recording) as one continuous file,
+                        without splitting it into tracks, plus a CUE sheet
+                        listing the titles played.
+  -show-template <TEMPLATE>
+                    --  Filename of show recordings, relative to the
+                        output directory (default: '`+recorder.DefaultShowTemplate+`').
+                        Placeholders: {show}, {station}, {date}, {time},
+                        {ext}.
+  -archive <DURATION>
+                    --  Also write the whole stream, including tracks that
+                        aren't saved, into segments of <DURATION> (e.g.
+                        '1h', at most a day) aligned to the clock. Each
+                        segment gets an index of the metadata changes
+                        ('<SEGMENT>`+recorder.ArchiveIndexExt+`') and a CUE sheet.
+  -archive-template <TEMPLATE>
+                    --  Filename of archive segments, relative to the
+                        output directory (default:
+                        '`+recorder.DefaultArchiveTemplate+`').
+                        Placeholders: {station}, {date}, {time}, {ext}.
+  -sink <SINK>      --  Where to save tracks; may be given multiple times to
+                        save each track in several places (default: dir):
+                        'dir': files in the output directory.
+                        'tar': one tar archive per station and day in the
+                        output directory ('<STATION> <DATE>.tar').
+                        'pipe:<COMMAND>': the standard input of <COMMAND>,
+                        run in the output directory for each track, e.g.
+                        'pipe:lame --decode - {base}.wav'. Placeholders:
+                        {filename}, {base}, {ext}, {artist}, {title},
+                        {station}, {date}. Commands run in the background,
+                        one track at a time, and failures are only logged.
+                        's3:<URL>': uploads to an S3-compatible object
+                        storage, with <URL> being
+                        'http[s]://<HOST>/<BUCKET>[/<KEY>]?region=<REGION>'.
+                        <KEY> may contain the same placeholders (default:
+                        '{filename}'). Credentials are read from
+                        AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. Tracks
+                        are spooled in '`+sink.SpoolDir+`' in the output
+                        directory until they are uploaded. Tracks the
+                        storage rejects (e.g. with "403 Forbidden") are
+                        moved to a '`+sink.QuarantineDir+`' subdirectory,
+                        unless it refuses the credentials, in which case
+                        all tracks are kept until the credentials work.
+                        'webdav:<URL>': uploads to a WebDAV server, creating
+                        collections as needed, with <URL> being
+                        'http[s]://[<USER>:<PASSWORD>@]<HOST>/<PATH>'. <PATH>
+                        may contain the same placeholders (default:
+                        '{filename}' after a trailing slash). Credentials
+                        may also be given in RSR_WEBDAV_USER and
+                        RSR_WEBDAV_PASSWORD. Spooled like with 's3'.
+                        'null': nowhere (for dry runs).
+                        Sidecars are saved along with tracks by all sinks
+                        but 'pipe' and 'null'. Playlists and the catalog
+                        require 'dir'. Shows and archive segments are
+                        always files.
+  -max-reconnects <NUM>
+                    --  Give up on a station after <NUM> failed attempts
+                        in a row to reconnect (default: never give up).
+  -min-free <SIZE>  --  Check that there is at least <SIZE> (e.g. '2G') of
+                        free space before saving anything.
+  -on-low-space <pause|stop>
+                    --  What to do when there is less free space: pause
+                        recording until there is enough again, or stop
+                        (default: pause).
+  -max-age <DURATION>
+                    --  Delete recordings older than <DURATION> (e.g.
+                        '720h' or '30d').
+  -max-size <SIZE>  --  Delete the oldest recordings while all of them take
+                        up more than <SIZE>.
+  -max-files <NUM>  --  Delete the oldest recordings while there are more
+                        than <NUM>.
+  -retain-ext <EXT> --  Also apply the retention limits to files ending in
+                        <EXT>, e.g. '.opus' for tracks encoded by a 'pipe:'
+                        sink; may be given multiple times.
+                        Retention limits apply to all recordings in the
+                        output directory and its subdirectories (.mp3, .ogg
+                        and .tar files, and those given by -retain-ext).
+                        Sidecars, CUE sheets and archive indexes are deleted
+                        along with their recordings.
+  -on-save <COMMAND>
+                    --  Run <COMMAND> with the shell after each track is
+                        saved, with its path and metadata in environment
+                        variables: RSR_FILE, RSR_FILENAME, RSR_ARTIST,
+                        RSR_TITLE, RSR_ALBUM, RSR_STATION, RSR_DURATION
+                        (seconds), RSR_SIZE (bytes) and RSR_REASON (why
+                        the track is partial).
+  -on-discard <COMMAND>
+                    --  Run <COMMAND> for each track that is discarded,
+                        with RSR_REASON or RSR_ERROR saying why.
+  -on-connect <COMMAND>
+                    --  Run <COMMAND> after connecting to a station.
+  -on-disconnect <COMMAND>
+                    --  Run <COMMAND> when the connection to a station is
+                        lost, with RSR_ERROR saying why.
+  -hook-limit <NUM> --  Run at most <NUM> commands at a time (default: 2).
+  -hook-timeout <DURATION>
+                    --  Kill commands running longer than <DURATION>
+                        (default: 10m). Their output is logged.
+  -webhook <URL>    --  POST a JSON description of each event to <URL>; may
+                        be given multiple times. Requests are retried a few
+                        times, but dropped if they can't keep up.
+  -webhook-events <EVENTS>
+                    --  Comma separated events to send (default:
+                        connected, disconnected, gave_up, track_saved,
+                        track_discarded, track_failed, low_disk_space,
+                        disk_space_recovered).
+  -webhook-secret <SECRET>
+                    --  Sign requests with an HMAC-SHA256 of the body keyed
+                        with <SECRET>, sent as 'X-RSR-Signature-256:
+                        sha256=<HEX>'. May also be given in
+                        RSR_WEBHOOK_SECRET.
+  -listen <ADDR>    --  Serve the HTTP API (see below) on <ADDR>, e.g.
+                        ':8080'. Keeps running until interrupted, even
+                        without any stations.
+  -api-token <TOKEN>
+                    --  Require 'Authorization: Bearer <TOKEN>' for the
+                        HTTP API. May also be given in RSR_API_TOKEN.
+  -log-level <LEVEL>
+                    --  Only log messages of <LEVEL> or above: debug,
+                        info (default), warn or error.
+  -log-format <FORMAT>
+                    --  'text' (default) or 'json' (one object per line).
+  -log-file <FILE>  --  Log to <FILE> instead of the terminal.
+  -log-max-size <SIZE>
+                    --  Rotate the log file once it grows larger than
+                        <SIZE> (default: 10M): It's renamed to '<FILE>.1',
+                        the previous '<FILE>.1' to '<FILE>.2' and so on.
+  -log-max-files <NUM>
+                    --  Keep at most <NUM> rotated log files (default: 5).
+
+Filter fields:
+  artist, title, streamtitle (raw ICY title) or any Vorbis comment field.
+
+Schedule rules:
+  '<DAYS> <HH:MM>-<HH:MM> [<TIMEZONE>]', e.g. 'Sat 20:00-22:00 Europe/Berlin'
+  or 'Mon-Fri,Sun 06:00-09:00'. <DAYS> may also be 'daily'. When a window
+  closes, the track in progress is saved as a partial track.
+
+Stations file:
+  [{"name": "<NAME>", "url": "<STREAM_URL>", "dir": "<DIRECTORY>",
+    "schedule": ["<RULE>", ...], "lead": <SECONDS>, "pre_roll": <SECONDS>,
+    "post_roll": <SECONDS>, "debounce": <SECONDS>,
+    "split_every": <SECONDS>, "fallback_after": <SECONDS>, "show": "<NAME>",
+    "show_template": "<TEMPLATE>", "archive": <SECONDS>,
+    "archive_template": "<TEMPLATE>", "sinks": ["<SINK>", ...],
+    "max_age": <SECONDS>, "max_size": "<SIZE>", "max_files": <NUM>}, ...]
+  Only "url" is required. Relative directories are relative to -dir. Unset
+  options default to the command line options.
+
+HTTP API:
+  GET    /stations               --  List stations and what they're doing.
+  POST   /stations               --  Add a station, described like in the
+                                     stations file ("name" is required,
+                                     "dir" must be inside -dir, no 'pipe'
+                                     sinks).
+  GET    /stations/<NAME>        --  Show a station.
+  DELETE /stations/<NAME>        --  Stop recording a station, saving the
+                                     track in progress as a partial track.
+  POST   /stations/<NAME>/pause  --  Discard the track in progress and
+                                     disconnect until resumed.
+  POST   /stations/<NAME>/resume
+  POST   /stations/<NAME>/split  --  Start a new track right away.
+  POST   /stations/<NAME>/skip   --  Discard the track in progress.
+  GET    /metrics                --  Metrics of all stations in the
+                                     Prometheus text format.
+  The unnamed station given by <STREAM_URL> is called "stream".
 
 Output types:
+  - <DEBUG>
   * <INFO>
-  `+colYellow+`! <WARNING>`+colReset+`
-  `+colRed+`! <ERROR>`+colReset)
+  ! <WARNING>
+  !! <ERROR>
+  Warnings and errors go to standard error and are colored if it's a
+  terminal and NO_COLOR isn't set. With '-log-format json', each message is
+  a JSON object with "time", "level", "msg" and, if applicable, "station"
+  and "track".`)
 	os.Exit(exitStatus)
 }
 
-func printInfo(f string, v ...interface{}) {
-	fmt.Printf("* "+f+"\n", v...)
-}
-
-func printWarn(f string, v ...interface{}) {
-	fmt.Fprintf(os.Stderr, colYellow+"! "+f+colReset+"\n", v...)
-}
-
-func printNonFatalErr(f string, v ...interface{}) {
-	fmt.Fprintf(os.Stderr, colRed+"! "+f+colReset+"\n", v...)
-}
-
-func printErr(f string, v ...interface{}) {
-	printNonFatalErr(f, v...)
+// Logs an error and exits.
+func fatalf(f string, v ...interface{}) {
+	logger.Errorf(f, v...)
 	os.Exit(1)
 }
 
-func record(url, dir string) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		printErr("HTTP request error: %v", err)
-	}
-	req.Header.Add("Icy-MetaData", "1") // Request metadata for icecast mp3 streams.
-	resp, err := client.Do(req)
-	if err != nil {
-		printErr("HTTP error: %v", err)
+// Parses a non-negative number of seconds given as an option argument.
+func parseSeconds(s string) time.Duration {
+	sec, err := strconv.ParseFloat(s, 64)
+	if err != nil || sec < 0 {
+		fatalf("'%v' is not a valid number of seconds", s)
 	}
-	defer resp.Body.Close()
-
-	var extractor model.Extractor
+	return time.Duration(sec * float64(time.Second))
+}
 
-	// Set up extractor depending on content type.
-	contentType := resp.Header.Get("content-type")
-	err = nil
-	switch contentType {
-	case "application/ogg", "audio/ogg", "audio/vorbis", "audio/vorbis-config":
-		extractor, err = vorbis.NewExtractor()
-	case "audio/mpeg", "audio/MPA", "audio/mpa-robust":
-		extractor, err = mp3.NewExtractor(resp.Header)
-	default:
-		printErr(`Content type '%v' not supported, supported formats:
-    Ogg/Vorbis ('application/ogg', 'audio/ogg', 'audio/vorbis', 'audio/vorbis-config')
-    mp3 ('audio/mpeg', 'audio/MPA', 'audio/mpa-robust')`, contentType)
+func handleEvent(e recorder.Event) {
+	hooks.Handle(e, newStationLogger(e.Station))
+	for _, w := range webhooks {
+		w.Send(e)
 	}
-	if err != nil {
-		printErr("%v", err)
+	if e.Type == recorder.TrackSaved {
+		countTrack()
 	}
+}
 
-	printInfo("Stream type: '%v'", contentType)
-
-	// Make reader blocking.
-	r := util.NewWaitReader(resp.Body)
-
-	// The first track is always discarded, as streams usually don't start at
-	// the exact end of a track, meaning it is almost certainly going to be
-	// incomplete.
-	discard := true
-
-	var rawFile bytes.Buffer
-	var filename string
-	var hasFilename bool
+// Counts a saved track and stops recording once the limit given by `-n` is
+// reached.
+func countTrack() {
+	nTracksRecordedMu.Lock()
+	defer nTracksRecordedMu.Unlock()
+	nTracksRecorded++
+	if limitTracks && nTracksRecorded == maxTracks {
+		logger.Infof("Successfully recorded %v tracks, exiting", nTracksRecorded)
+		stopRecording()
+	}
+}
 
-	for {
-		var block bytes.Buffer
+// Waits for running hooks and queued webhook requests.
+func finishNotifications() {
+	hooks.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), webhookFlushTimeout)
+	defer cancel()
+	for _, w := range webhooks {
+		w.Close(ctx)
+	}
+}
 
-		wasFirst, err := extractor.ReadBlock(r, &block)
+// Parses a duration, which may also be given in days, e.g. "30d".
+func parseAge(s string) (time.Duration, error) {
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.ParseFloat(days, 64)
 		if err != nil {
-			printNonFatalErr("Error reading block: %v", err)
-			// Reconnect, because this error is usually caused by a
-			// file corruption or a network error.
-			return
-		}
-
-		if wasFirst &&
-			// We only care about the beginning of a new file when it marks an
-			// old file's end, which is not the case in the beginning of the
-			// first file.
-			rawFile.Len() > 0 {
-			if !discard {
-				// Save previous track.
-				if !hasFilename {
-					printNonFatalErr("Error: Could not get a track filename")
-					continue
-				}
-				filePath := path.Join(dir, filename)
-				err := os.WriteFile(filePath, rawFile.Bytes(), 0666)
-				if err != nil {
-					printNonFatalErr("Error writing file: %v", err)
-					continue
-				}
-				printInfo("Saved track as: %v", filePath)
-
-				// Stop after the defined number of tracks (if the option was
-				// given).
-				nTracksRecorded++
-				if limitTracks && nTracksRecorded >= maxTracks {
-					printInfo("Successfully recorded %v tracks, exiting", nTracksRecorded)
-					os.Exit(0)
-				}
-			} else {
-				// See declaration of `discard`.
-				discard = false
-			}
-
-			// Reset everything.
-			rawFile.Reset()
-			hasFilename = false
+			return 0, err
 		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(s)
+}
 
-		// Try to find out the current track's filename.
-		if !hasFilename {
-			if f, ok := extractor.TryGetFilename(); ok {
-				if discard {
-					printInfo("Discarding track: %v", f)
-				} else {
-					printInfo("Recording track: %v", f)
-				}
-				filename = f
-				hasFilename = true
-			}
+// Parses the argument of `-until`.
+func parseUntil(s string) (time.Time, error) {
+	now := time.Now()
+	if t, err := time.ParseInLocation("15:04", s, time.Local); err == nil {
+		// The next time the clock shows the given time of day.
+		ret := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+		if !ret.After(now) {
+			ret = ret.AddDate(0, 0, 1)
 		}
-
-		// Append block to the current file byte buffer.
-		rawFile.Write(block.Bytes())
+		return ret, nil
 	}
+	if t, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
 }
 
 func main() {
 	var url string
 	dir := "."
+	var stationsFile string
+	var until time.Time // One-off recording end, if set.
+	var showName string
+	webhookSecret := os.Getenv("RSR_WEBHOOK_SECRET")
+	var listenAddr string
+	logLevel := logging.Info
+	var logFormat logging.Format
+	var logFile string
+	logMaxSize := uint64(logging.DefaultMaxSize)
+	logMaxFiles := logging.DefaultMaxFiles
+	apiToken := os.Getenv("RSR_API_TOKEN")
 
 	if len(os.Args) < 2 {
 		usage(os.Args[0], 1)
@@ -185,7 +450,7 @@ func main() {
 		expectArg := func(currArg string) string {
 			i++
 			if i >= len(os.Args) {
-				printErr("Expected argument after option '%v'", currArg)
+				fatalf("Expected argument after option '%v'", currArg)
 			}
 			return os.Args[i]
 		}
@@ -199,38 +464,429 @@ func main() {
 				nStr := expectArg(arg)
 				n, err := strconv.ParseInt(nStr, 10, 32)
 				if err != nil || n <= 0 {
-					printErr("'%v' is not an integer larger than zero", nStr)
+					fatalf("'%v' is not an integer larger than zero", nStr)
 				}
 				limitTracks = true
 				maxTracks = int(n)
+			case "-include", "-exclude":
+				action := filter.Include
+				if arg == "-exclude" {
+					action = filter.Exclude
+				}
+				rule, err := filter.ParseRule(action, expectArg(arg))
+				if err != nil {
+					fatalf("%v", err)
+				}
+				filterRules = append(filterRules, rule)
+			case "-filter":
+				f, err := filter.OpenFile(expectArg(arg))
+				if err != nil {
+					fatalf("Error reading filter rules: %v", err)
+				}
+				filterFile = f
+			case "-skip-existing":
+				skipExisting = true
+			case "-rerecord-if-longer":
+				rerecordIfLonger = true
+			case "-sidecar":
+				writeSidecars = true
+			case "-playlist":
+				writePlaylists = true
+			case "-history":
+				writeHistory = true
+			case "-interrupted":
+				switch policy := expectArg(arg); policy {
+				case "save":
+					saveInterrupted = true
+				case "discard":
+					saveInterrupted = false
+				default:
+					fatalf("Expected 'save' or 'discard', but got '%v'", policy)
+				}
+			case "-keep-first":
+				keepFirst = true
+			case "-partial-suffix":
+				partialSuffix = expectArg(arg)
+			case "-partial-tag":
+				tagPartialTracks = true
+			case "-debounce":
+				titleDebounce = parseSeconds(expectArg(arg))
+			case "-split-every", "-fallback-after":
+				dStr := expectArg(arg)
+				d, err := time.ParseDuration(dStr)
+				if err != nil || d < time.Second {
+					fatalf("'%v' is not a valid duration", dStr)
+				}
+				if arg == "-split-every" {
+					splitEvery = d
+				} else {
+					fallbackAfter = d
+				}
+			case "-pre-roll":
+				preRoll = parseSeconds(expectArg(arg))
+			case "-post-roll":
+				postRoll = parseSeconds(expectArg(arg))
+			case "-stations":
+				stationsFile = expectArg(arg)
+			case "-schedule":
+				scheduleRules = append(scheduleRules, expectArg(arg))
+			case "-lead":
+				scheduleLead = parseSeconds(expectArg(arg))
+			case "-duration":
+				dStr := expectArg(arg)
+				d, err := time.ParseDuration(dStr)
+				if err != nil || d <= 0 {
+					fatalf("'%v' is not a valid duration", dStr)
+				}
+				until = time.Now().Add(d)
+			case "-until":
+				tStr := expectArg(arg)
+				t, err := parseUntil(tStr)
+				if err != nil {
+					fatalf("'%v' is not a valid time", tStr)
+				}
+				until = t
+			case "-show":
+				showName = expectArg(arg)
+				if showName == "" {
+					fatalf("Expected a show name")
+				}
+			case "-show-template":
+				showTemplate = expectArg(arg)
+			case "-archive":
+				dStr := expectArg(arg)
+				d, err := time.ParseDuration(dStr)
+				if err != nil || d < time.Second {
+					fatalf("'%v' is not a valid segment length", dStr)
+				}
+				archiveLength = d
+			case "-archive-template":
+				archiveTemplate = expectArg(arg)
+			case "-sink":
+				sinkSpecs = append(sinkSpecs, expectArg(arg))
+			case "-max-reconnects":
+				nStr := expectArg(arg)
+				n, err := strconv.ParseInt(nStr, 10, 32)
+				if err != nil || n <= 0 {
+					fatalf("'%v' is not an integer larger than zero", nStr)
+				}
+				maxReconnects = int(n)
+			case "-min-free", "-max-size":
+				size, err := storage.ParseSize(expectArg(arg))
+				if err != nil {
+					fatalf("%v", err)
+				}
+				if arg == "-min-free" {
+					minFree = size
+				} else {
+					retention.MaxSize = size
+				}
+			case "-on-low-space":
+				switch action := expectArg(arg); action {
+				case "pause":
+					stopOnLowSpace = false
+				case "stop":
+					stopOnLowSpace = true
+				default:
+					fatalf("Expected 'pause' or 'stop', but got '%v'", action)
+				}
+			case "-max-age":
+				dStr := expectArg(arg)
+				d, err := parseAge(dStr)
+				if err != nil || d <= 0 {
+					fatalf("'%v' is not a valid duration", dStr)
+				}
+				retention.MaxAge = d
+			case "-max-files":
+				nStr := expectArg(arg)
+				n, err := strconv.ParseInt(nStr, 10, 32)
+				if err != nil || n <= 0 {
+					fatalf("'%v' is not an integer larger than zero", nStr)
+				}
+				retention.MaxFiles = int(n)
+			case "-retain-ext":
+				ext := strings.ToLower(expectArg(arg))
+				if !strings.HasPrefix(ext, ".") {
+					ext = "." + ext
+				}
+				if ext == "." || strings.ContainsAny(ext, `/\`) {
+					fatalf("'%v' is not a valid file extension", ext)
+				}
+				retention.Exts = append(retention.Exts, ext)
+			case "-on-save":
+				hooks.Hooks.OnSave = expectArg(arg)
+			case "-on-discard":
+				hooks.Hooks.OnDiscard = expectArg(arg)
+			case "-on-connect":
+				hooks.Hooks.OnConnect = expectArg(arg)
+			case "-on-disconnect":
+				hooks.Hooks.OnDisconnect = expectArg(arg)
+			case "-hook-limit":
+				nStr := expectArg(arg)
+				n, err := strconv.ParseInt(nStr, 10, 32)
+				if err != nil || n <= 0 {
+					fatalf("'%v' is not an integer larger than zero", nStr)
+				}
+				hooks.Limit = int(n)
+			case "-hook-timeout":
+				dStr := expectArg(arg)
+				d, err := time.ParseDuration(dStr)
+				if err != nil || d <= 0 {
+					fatalf("'%v' is not a valid duration", dStr)
+				}
+				hooks.Timeout = d
+			case "-webhook":
+				webhookURLs = append(webhookURLs, expectArg(arg))
+			case "-webhook-events":
+				events, err := webhook.ParseEvents(expectArg(arg))
+				if err != nil {
+					fatalf("%v", err)
+				}
+				webhookEvents = events
+			case "-webhook-secret":
+				webhookSecret = expectArg(arg)
+			case "-listen":
+				listenAddr = expectArg(arg)
+			case "-api-token":
+				apiToken = expectArg(arg)
+			case "-log-level":
+				l, err := logging.ParseLevel(expectArg(arg))
+				if err != nil {
+					fatalf("%v", err)
+				}
+				logLevel = l
+			case "-log-format":
+				f, err := logging.ParseFormat(expectArg(arg))
+				if err != nil {
+					fatalf("%v", err)
+				}
+				logFormat = f
+			case "-log-file":
+				logFile = expectArg(arg)
+			case "-log-max-size":
+				size, err := storage.ParseSize(expectArg(arg))
+				if err != nil {
+					fatalf("%v", err)
+				}
+				if size == 0 {
+					fatalf("Log files can't be limited to 0 bytes")
+				}
+				logMaxSize = size
+			case "-log-max-files":
+				nStr := expectArg(arg)
+				n, err := strconv.ParseInt(nStr, 10, 32)
+				if err != nil || n <= 0 {
+					fatalf("'%v' is not an integer larger than zero", nStr)
+				}
+				logMaxFiles = int(n)
 			case "--help", "-h":
 				usage(os.Args[0], 0)
 			default:
-				printErr("Unknown option: '%v'", arg)
+				fatalf("Unknown option: '%v'", arg)
 			}
 		} else {
 			if url == "" {
 				url = arg
 			} else {
-				printErr("Expected option, but got '%v'", arg)
+				fatalf("Expected option, but got '%v'", arg)
 			}
 		}
 	}
 
-	if url == "" {
-		printInfo("Please specify a stream URL")
+	logOpts := logging.Options{
+		Level:     logLevel,
+		Format:    logFormat,
+		Output:    os.Stdout,
+		ErrOutput: os.Stderr,
+		Color:     logFormat == logging.Text && logging.ColorTerminal(os.Stdout),
+		ErrColor:  logFormat == logging.Text && logging.ColorTerminal(os.Stderr),
+	}
+	if logFile != "" {
+		f, err := logging.OpenRotatingFile(logFile, int64(logMaxSize), logMaxFiles)
+		if err != nil {
+			fatalf("Error opening log file: %v", err)
+		}
+		defer f.Close()
+		logOpts.Output, logOpts.ErrOutput = f, nil
+		logOpts.Color, logOpts.ErrColor = false, false
+		logOpts.Timestamps = true
+	}
+	logger = logging.New(logOpts)
+
+	var stations []stationConfig
+	if stationsFile != "" {
+		if url != "" {
+			fatalf("Expected either a stream URL or '-stations', not both")
+		}
+		var err error
+		stations, err = loadStations(stationsFile, dir)
+		if err != nil {
+			fatalf("Error reading stations: %v", err)
+		}
+	} else if url != "" {
+		stations = []stationConfig{{URL: url, Dir: dir, Show: showName}}
+	} else if listenAddr == "" {
+		logger.Infof("Please specify a stream URL")
 		os.Exit(1)
 	}
 
-	printInfo("URL: %v", url)
-	printInfo("Output directory: %v", dir)
+	if skipExisting && rerecordIfLonger {
+		fatalf("Options '-skip-existing' and '-rerecord-if-longer' are mutually exclusive")
+	}
+	if showName != "" && stationsFile != "" {
+		fatalf("Option '-show' only applies to a single stream URL, use \"show\" in the stations file instead")
+	}
+	if !until.IsZero() && len(scheduleRules) > 0 {
+		fatalf("Options '-duration'/'-until' and '-schedule' are mutually exclusive")
+	}
+
+	if url != "" {
+		logger.Infof("URL: %v", url)
+	} else if stationsFile != "" {
+		logger.Infof("Stations file: %v", stationsFile)
+	}
+	logger.Infof("Output directory: %v", dir)
 	if limitTracks {
-		printInfo("Stopping after %v tracks", maxTracks)
+		logger.Infof("Stopping after %v tracks", maxTracks)
+	}
+	if titleDebounce > 0 {
+		logger.Infof("Title changes debounced by %v", titleDebounce)
+	}
+	if fallbackAfter > 0 {
+		logger.Infof("Splitting by time while the title is unchanged for %v", fallbackAfter)
+	}
+	if preRoll > 0 || postRoll > 0 {
+		logger.Infof("Padding tracks with %v pre-roll and %v post-roll", preRoll, postRoll)
+	}
+	for _, r := range filterRules {
+		logger.Infof("Filter rule: %v", r)
+	}
+	if filterFile != nil {
+		logger.Infof("Filter rules file: %v", filterFile.Path())
+	}
+	if skipExisting {
+		logger.Infof("Skipping tracks listed in '%v'", catalog.Filename)
+	} else if rerecordIfLonger {
+		logger.Infof("Replacing tracks listed in '%v' only by longer takes", catalog.Filename)
+	}
+	for _, spec := range sinkSpecs {
+		logger.Infof("Saving tracks to: %v", sink.Redact(spec))
+	}
+	if showName != "" {
+		logger.Infof("Recording show '%v' as one file per recording window", showName)
+	}
+	if archiveLength > 0 {
+		logger.Infof("Archiving the whole stream in segments of %v", archiveLength)
+	}
+	if minFree > 0 {
+		action := "Pausing"
+		if stopOnLowSpace {
+			action = "Stopping"
+		}
+		logger.Infof("%v recording with less than %v of free space", action, storage.FormatSize(minFree))
+	}
+	if retention.MaxAge > 0 {
+		logger.Infof("Deleting recordings older than %v", storage.FormatAge(retention.MaxAge))
+	}
+	if retention.MaxSize > 0 {
+		logger.Infof("Keeping at most %v of recordings", storage.FormatSize(retention.MaxSize))
+	}
+	if retention.MaxFiles > 0 {
+		logger.Infof("Keeping at most %v recordings", retention.MaxFiles)
+	}
+	if len(retention.Exts) > 0 {
+		logger.Infof("Retention limits also apply to: %v", strings.Join(retention.Exts, ", "))
+	}
+	for _, h := range []struct{ name, command string }{
+		{"on-save", hooks.Hooks.OnSave},
+		{"on-discard", hooks.Hooks.OnDiscard},
+		{"on-connect", hooks.Hooks.OnConnect},
+		{"on-disconnect", hooks.Hooks.OnDisconnect},
+	} {
+		if h.command != "" {
+			logger.Infof("Hook %v: %v", h.name, h.command)
+		}
+	}
+	for _, u := range webhookURLs {
+		w, err := webhook.New(u, webhook.Options{
+			Secret: webhookSecret,
+			Events: webhookEvents,
+			Logger: newStationLogger(""),
+		})
+		if err != nil {
+			fatalf("%v", err)
+		}
+		webhooks = append(webhooks, w)
+		logger.Infof("Sending events to webhook: %v", w)
+	}
+	if !until.IsZero() {
+		logger.Infof("Recording until %v", until.Format("2006-01-02 15:04:05"))
+	}
+
+	// Stop recording gracefully when interrupted.
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(sigCtx)
+	defer cancel()
+	stopRecording = cancel
+	m := newStationManager(ctx, until)
+
+	// Set up all stations before starting any of them, so configuration
+	// errors are reported right away.
+	var recorders []*recorder.Recorder
+	for _, cfg := range stations {
+		rec, err := m.newRecorder(cfg)
+		if err != nil {
+			newStationLogger(cfg.Name).fatalf("%v", err)
+		}
+		recorders = append(recorders, rec)
 	}
 
-	// Record the actual stream.
-	for {
-		record(url, dir)
-		printInfo("Reconnecting due to previous error")
+	var server *http.Server
+	serveErr := make(chan error, 1)
+	if listenAddr != "" {
+		l, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		server = &http.Server{Handler: &apiServer{m: m, dir: dir, token: apiToken}}
+		go func() {
+			if err := server.Serve(l); err != http.ErrServerClosed {
+				// Stop all stations, like after a signal.
+				logger.Errorf("HTTP API: %v", err)
+				serveErr <- err
+				cancel()
+			}
+		}()
+		// Stations can be added again, so don't exit if one fails.
+		m.exitOnError = false
+		logger.Infof("Serving the HTTP API on %v", l.Addr())
+	}
+
+	// Record the actual streams.
+	for i, rec := range recorders {
+		if _, err := m.start(stations[i], rec); err != nil {
+			fatalf("%v", err)
+		}
+	}
+	if server != nil {
+		<-m.ctx.Done()
+		server.Shutdown(context.Background())
+	}
+	m.wait()
+	// Tracks may still be waiting for their pipe commands.
+	sink.Wait()
+	finishNotifications()
+	failed := m.gaveUp > 0 || m.failed > 0
+	select {
+	case <-serveErr:
+		failed = true
+	default:
+		if sigCtx.Err() != nil {
+			logger.Infof("Stopped")
+		}
+	}
+	if failed {
+		os.Exit(1)
 	}
 }
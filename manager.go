@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"rsr/recorder"
+	"rsr/schedule"
+	"rsr/storage"
+)
+
+var (
+	errDuplicateStation = errors.New("a station with this name exists already")
+	errUnknownStation   = errors.New("no such station")
+	errShuttingDown     = errors.New("shutting down")
+)
+
+// A station being recorded.
+type runningStation struct {
+	name   string // Unique name, also used by the API.
+	rec    *recorder.Recorder
+	cancel context.CancelFunc
+	done   chan struct{} // Closed once recording stopped.
+}
+
+// Keeps track of the stations being recorded, which may be added and removed
+// while running.
+type stationManager struct {
+	ctx    context.Context
+	cancel context.CancelFunc // Stops all stations.
+	until  time.Time          // One-off recording end for stations without a schedule.
+	// Whether errors stopping a station stop all stations, so the program
+	// exits. They don't when stations can be managed through the API.
+	exitOnError bool
+
+	mu       sync.Mutex
+	stations []*runningStation
+	wg       sync.WaitGroup
+	gaveUp   int32 // Number of stations given up on.
+	failed   int32 // Number of stations stopped by other errors.
+}
+
+func newStationManager(ctx context.Context, until time.Time) *stationManager {
+	ctx, cancel := context.WithCancel(ctx)
+	return &stationManager{ctx: ctx, cancel: cancel, until: until, exitOnError: true}
+}
+
+// Returns the name a station is known by. Only a single station given on the
+// command line may be unnamed.
+func stationName(cfg stationConfig) string {
+	if cfg.Name == "" {
+		return "stream"
+	}
+	return cfg.Name
+}
+
+// Returns a recorder for a station, reporting configuration errors.
+func (m *stationManager) newRecorder(cfg stationConfig) (*recorder.Recorder, error) {
+	opts, err := cfg.options()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Schedule == nil && !m.until.IsZero() {
+		opts.Schedule = schedule.Once{Start: time.Now(), End: m.until}
+	}
+	return recorder.New(opts)
+}
+
+// Starts recording a station with a recorder set up by `newRecorder()`.
+func (m *stationManager) start(cfg stationConfig, rec *recorder.Recorder) (*runningStation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.ctx.Err() != nil {
+		return nil, errShuttingDown
+	}
+	name := stationName(cfg)
+	for _, s := range m.stations {
+		if s.name == name {
+			return nil, fmt.Errorf("%w: '%v'", errDuplicateStation, name)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	s := &runningStation{name: name, rec: rec, cancel: cancel, done: make(chan struct{})}
+	m.stations = append(m.stations, s)
+	m.wg.Add(1)
+	go func(log stationLogger) {
+		defer m.wg.Done()
+		defer close(s.done)
+		err := rec.Run(ctx)
+		if errors.Is(err, recorder.ErrGaveUp) || errors.Is(err, storage.ErrLowSpace) {
+			// Keep recording the other stations.
+			log.Errorf("%v", err)
+			atomic.AddInt32(&m.gaveUp, 1)
+		} else if err != nil {
+			log.Errorf("%v", err)
+			atomic.AddInt32(&m.failed, 1)
+			if m.exitOnError {
+				m.cancel()
+			}
+		}
+	}(newStationLogger(cfg.Name))
+	return s, nil
+}
+
+// Adds a station and starts recording it.
+func (m *stationManager) add(cfg stationConfig) (*runningStation, error) {
+	rec, err := m.newRecorder(cfg)
+	if err != nil {
+		return nil, err
+	}
+	s, err := m.start(cfg, rec)
+	if err == nil {
+		logger.Infof("Added station: %v", s.name)
+	}
+	return s, err
+}
+
+// Stops recording a station, waiting until whatever was being recorded is
+// saved, and forgets about it.
+func (m *stationManager) remove(name string) error {
+	m.mu.Lock()
+	var s *runningStation
+	for i, st := range m.stations {
+		if st.name == name {
+			s = st
+			m.stations = append(m.stations[:i], m.stations[i+1:]...)
+			break
+		}
+	}
+	m.mu.Unlock()
+	if s == nil {
+		return errUnknownStation
+	}
+	s.cancel()
+	<-s.done
+	logger.Infof("Removed station: %v", name)
+	return nil
+}
+
+func (m *stationManager) find(name string) *runningStation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.stations {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (m *stationManager) list() []*runningStation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*runningStation(nil), m.stations...)
+}
+
+// Waits until all stations stopped recording.
+func (m *stationManager) wait() {
+	m.wg.Wait()
+}
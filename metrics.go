@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A metric in the Prometheus text exposition format.
+type metric struct {
+	name, typ, help string
+	samples         []sample
+}
+
+type sample struct {
+	labels []string // Alternating names and values.
+	value  float64
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func (m *metric) add(value float64, labels ...string) {
+	m.samples = append(m.samples, sample{labels: labels, value: value})
+}
+
+func (m *metric) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n", m.name, helpEscaper.Replace(m.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", m.name, m.typ)
+	for _, s := range m.samples {
+		io.WriteString(w, m.name)
+		if len(s.labels) > 0 {
+			io.WriteString(w, "{")
+			for i := 0; i+1 < len(s.labels); i += 2 {
+				if i > 0 {
+					io.WriteString(w, ",")
+				}
+				fmt.Fprintf(w, `%v="%v"`, s.labels[i], labelEscaper.Replace(s.labels[i+1]))
+			}
+			io.WriteString(w, "}")
+		}
+		fmt.Fprintf(w, " %v\n", strconv.FormatFloat(s.value, 'f', -1, 64))
+	}
+}
+
+// Serves the metrics of all stations in the Prometheus text format.
+func (a *apiServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, "GET") {
+		return
+	}
+	newMetric := func(name, typ, help string) *metric {
+		return &metric{name: "rsr_" + name, typ: typ, help: help}
+	}
+	var (
+		bytesReceived   = newMetric("bytes_received_total", "counter", "Bytes of stream data received.")
+		blocksRead      = newMetric("blocks_read_total", "counter", "Frames (mp3) or pages (Ogg) read.")
+		tracksSaved     = newMetric("tracks_saved_total", "counter", "Tracks saved.")
+		tracksDiscarded = newMetric("tracks_discarded_total", "counter", "Tracks discarded, e.g. by filters or because they are incomplete.")
+		tracksFailed    = newMetric("tracks_failed_total", "counter", "Tracks that couldn't be saved.")
+		reconnects      = newMetric("reconnects_total", "counter", "Reconnects by reason.")
+		checksumErrors  = newMetric("ogg_checksum_errors_total", "counter", "Ogg pages with an invalid checksum.")
+		metadataErrors  = newMetric("icy_metadata_errors_total", "counter", "Malformed ICY metadata blocks.")
+		connected       = newMetric("connected", "gauge", "Whether the station is connected.")
+		uptime          = newMetric("connection_uptime_seconds", "gauge", "Time since connecting, 0 if not connected.")
+		lastSaved       = newMetric("last_track_saved_timestamp_seconds", "gauge", "Unix time the last track was saved at.")
+	)
+
+	now := time.Now()
+	for _, s := range a.m.list() {
+		st := s.rec.Status()
+		bytesReceived.add(float64(st.BytesReceived), "station", s.name)
+		blocksRead.add(float64(st.BlocksRead), "station", s.name)
+		tracksSaved.add(float64(st.TracksSaved), "station", s.name)
+		tracksDiscarded.add(float64(st.TracksDiscarded), "station", s.name)
+		tracksFailed.add(float64(st.TracksFailed), "station", s.name)
+		reasons := make([]string, 0, len(st.Reconnects))
+		for reason := range st.Reconnects {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			reconnects.add(float64(st.Reconnects[reason]), "station", s.name, "reason", reason)
+		}
+		checksumErrors.add(float64(st.OggChecksumErrors), "station", s.name)
+		metadataErrors.add(float64(st.MetadataErrors), "station", s.name)
+		if st.Connected {
+			connected.add(1, "station", s.name)
+		} else {
+			connected.add(0, "station", s.name)
+		}
+		if st.ConnectedSince != nil {
+			uptime.add(now.Sub(*st.ConnectedSince).Seconds(), "station", s.name)
+		} else {
+			uptime.add(0, "station", s.name)
+		}
+		if st.LastTrackSaved != nil {
+			lastSaved.add(float64(st.LastTrackSaved.UnixNano())/1e9, "station", s.name)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, m := range []*metric{
+		bytesReceived, blocksRead, tracksSaved, tracksDiscarded, tracksFailed,
+		reconnects, checksumErrors, metadataErrors, connected, uptime, lastSaved,
+	} {
+		m.write(bw)
+	}
+	bw.Flush()
+}
@@ -1,17 +1,52 @@
 package model
 
 import (
+	"fmt"
 	"io"
+	"time"
 )
 
+// A block of a radio stream, as read by an `Extractor`. A block can be any
+// chunk of data, depending on the file format, for example in Ogg/Vorbis it
+// would be equivalent to a page.
+type Block struct {
+	// The part of the block containing the actual music data, including any
+	// container framing (e.g. Ogg pages), but not the stream's metadata.
+	Data []byte
+	// Whether the block is the beginning of a new track.
+	Boundary bool
+	// The metadata of the current track. Only set on blocks after which it is
+	// new, i.e. once it becomes known for a track (which may be some blocks
+	// after the track's boundary) and whenever it changes during the track.
+	Metadata *Metadata
+	// A new title that was dropped in this block because it didn't persist
+	// for the debounce time, if any.
+	Dropped *Metadata
+
+	// Playback length of the audio data in the block. `Samples` (per
+	// channel) and `SampleRate` are 0 if they aren't known.
+	Samples    int64
+	SampleRate int
+	Duration   time.Duration
+}
+
 type Extractor interface {
-	// Reads a single "block" from a radio stream. A block can be any chunk of
-	// data, depending on the file format, for example in Ogg/Vorbis it would
-	// be equivalent to a chunk. Writes the part containing the actual music
-	// data into `w`.
-	// `isFirst` is true, if the block read was the first block of a file.
-	ReadBlock(r io.Reader, w io.Writer) (isFirst bool, err error)
-	// Potentially returns a filename using format-specific metadata. Usually
-	// available after the first few blocks of a file were read.
-	TryGetFilename() (filename string, hasFilename bool)
+	// Reads a single block from a radio stream.
+	// If only the block's metadata couldn't be decoded, the block is
+	// returned along with a `*MetadataError` and the stream can still be
+	// read.
+	ReadBlock(r io.Reader) (*Block, error)
+}
+
+// An error in a block's metadata, which doesn't affect the music data.
+type MetadataError struct {
+	Err error
+}
+
+func (e *MetadataError) Error() string {
+	return fmt.Sprintf("invalid metadata: %v", e.Err)
+}
+
+func (e *MetadataError) Unwrap() error {
+	return e.Err
 }
@@ -0,0 +1,32 @@
+package model
+
+import (
+	"strings"
+)
+
+// Format-independent track metadata.
+type Metadata struct {
+	Artist string
+	Title  string
+	Album  string
+	// All raw metadata fields as reported by the stream, e.g. the Vorbis
+	// comment fields or the ICY metadata tags.
+	Fields map[string]string
+	// The metadata exactly as sent by the stream, if it is textual (as is the
+	// case for ICY metadata).
+	Raw string
+}
+
+// Looks up a raw metadata field. Field names are compared case insensitively,
+// since Vorbis comment and ICY metadata keys don't agree on capitalization.
+func (m Metadata) Field(name string) (val string, found bool) {
+	if v, ok := m.Fields[name]; ok {
+		return v, true
+	}
+	for k, v := range m.Fields {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,131 @@
+package mp3
+
+import (
+	"time"
+)
+
+// Bitrates in kbit/s, indexed by [version is MPEG-1][layer - 1][index].
+var bitrates = [2][3][15]int{
+	{ // MPEG-2 and MPEG-2.5
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	},
+	{ // MPEG-1
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+	},
+}
+
+// Sample rates in Hz, indexed by the version bits of the header.
+var sampleRates = [4][3]int{
+	{11025, 12000, 8000},  // MPEG-2.5
+	{0, 0, 0},             // Reserved
+	{22050, 24000, 16000}, // MPEG-2
+	{44100, 48000, 32000}, // MPEG-1
+}
+
+type frameHeader struct {
+	size       int // Frame size in bytes, including the header.
+	samples    int // Samples per channel.
+	sampleRate int
+}
+
+// Decodes a 4 byte MPEG audio frame header. `ok` is false if `p` is not a
+// valid header.
+func decodeFrameHeader(p []byte) (h frameHeader, ok bool) {
+	if p[0] != 0xFF || p[1]&0xE0 != 0xE0 {
+		return h, false
+	}
+	version := int(p[1]>>3) & 3
+	layer := 4 - int(p[1]>>1)&3 // 1, 2 or 3 (4 is reserved).
+	brIdx := int(p[2] >> 4)
+	srIdx := int(p[2]>>2) & 3
+	padding := int(p[2]>>1) & 1
+	// Reject reserved values and free format streams, whose frame size can't
+	// be determined from the header.
+	if version == 1 || layer == 4 || brIdx == 0 || brIdx == 15 || srIdx == 3 {
+		return h, false
+	}
+
+	mpeg1 := 0
+	if version == 3 {
+		mpeg1 = 1
+	}
+	bitrate := bitrates[mpeg1][layer-1][brIdx] * 1000
+	h.sampleRate = sampleRates[version][srIdx]
+
+	switch {
+	case layer == 1:
+		h.samples = 384
+		h.size = (12*bitrate/h.sampleRate + padding) * 4
+	case layer == 3 && mpeg1 == 0:
+		h.samples = 576
+		h.size = 72*bitrate/h.sampleRate + padding
+	default:
+		h.samples = 1152
+		h.size = 144*bitrate/h.sampleRate + padding
+	}
+	return h, true
+}
+
+// Keeps track of MPEG audio frames across the arbitrary chunks of data
+// received from the stream.
+type frameCounter struct {
+	pending    []byte // Beginning of a frame header cut off at the end of a chunk.
+	skip       int    // Remaining bytes of a frame continued in the next chunk.
+	sampleRate int    // Sample rate of the last frame (0 if there was none yet).
+}
+
+// Returns the number of samples (per channel) and the playback duration of
+// all frames starting within `p`.
+func (c *frameCounter) count(p []byte) (samples int64, dur time.Duration) {
+	buf := p
+	if len(c.pending) > 0 {
+		buf = append(c.pending, p...)
+		c.pending = nil
+	}
+
+	i := c.skip
+	c.skip = 0
+	for i+4 <= len(buf) {
+		h, ok := decodeFrameHeader(buf[i : i+4])
+		if !ok {
+			// Lost synchronization, search for the next frame header.
+			i++
+			continue
+		}
+		samples += int64(h.samples)
+		dur += time.Duration(h.samples) * time.Second / time.Duration(h.sampleRate)
+		c.sampleRate = h.sampleRate
+		i += h.size
+	}
+
+	if i > len(buf) {
+		c.skip = i - len(buf)
+	} else {
+		c.pending = append([]byte{}, buf[i:]...)
+	}
+	return samples, dur
+}
+
+// Returns the offset of the first frame starting within `p`, or -1 if there
+// is none. To avoid mistaking audio data for a frame header, the frame has to
+// be followed by another frame header, unless it extends past the end of `p`.
+func FrameStart(p []byte) int {
+	for i := 0; i+4 <= len(p); i++ {
+		h, ok := decodeFrameHeader(p[i : i+4])
+		if !ok {
+			continue
+		}
+		next := i + h.size
+		if next+4 > len(p) {
+			return i
+		}
+		if _, ok := decodeFrameHeader(p[next : next+4]); ok {
+			return i
+		}
+	}
+	return -1
+}
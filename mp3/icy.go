@@ -0,0 +1,96 @@
+package mp3
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrUnterminatedValue = errors.New("mp3: unterminated value in metadata")
+	ErrMissingValue      = errors.New("mp3: metadata key without value")
+)
+
+type MetadataField struct {
+	Key string
+	Val string
+}
+
+// Reports whether `s` starts with a metadata key followed by '='.
+func startsWithKey(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '=':
+			return i > 0
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '_', c == '-', c == '.':
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// Returns the index of the quote `q` terminating a quoted value in `s`, which
+// starts right after the opening quote. Servers don't escape quotes within
+// values (e.g. "StreamTitle='Guns N' Roses - Don't Cry';"), so a quote only
+// terminates the value if it is followed by the end of the metadata, or by a
+// ';' and then either the end of the metadata or the next key.
+func findValueEnd(s string, q byte) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] != q {
+			continue
+		}
+		rest := s[i+1:]
+		if strings.TrimSpace(rest) == "" {
+			return i
+		}
+		if rest[0] == ';' {
+			rest = strings.TrimLeft(rest[1:], " ")
+			if rest == "" || startsWithKey(rest) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// Parses ICY metadata in the format "k0='v0';k1='v1';". Quoted values may
+// contain quotes, semicolons and equals signs. If the metadata is malformed,
+// all fields up to the error are returned along with the error.
+func ParseMetadata(s string) ([]MetadataField, error) {
+	var ret []MetadataField
+	// Unused bytes of the last metadata block are set to '\0'.
+	s = strings.TrimRight(s, "\x00")
+	for {
+		s = strings.TrimLeft(s, "; \r\n")
+		if s == "" {
+			return ret, nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			return ret, ErrMissingValue
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+
+		var val string
+		if len(s) > 0 && (s[0] == '\'' || s[0] == '"') {
+			end := findValueEnd(s[1:], s[0])
+			if end < 0 {
+				ret = append(ret, MetadataField{Key: key, Val: s[1:]})
+				return ret, ErrUnterminatedValue
+			}
+			val = s[1 : end+1]
+			s = s[end+2:]
+		} else if semi := strings.IndexByte(s, ';'); semi >= 0 {
+			val = s[:semi]
+			s = s[semi:]
+		} else {
+			val = s
+			s = ""
+		}
+		ret = append(ret, MetadataField{Key: key, Val: val})
+	}
+}
@@ -0,0 +1,39 @@
+package mp3
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Encodes `n` as a 28 bit "syncsafe" integer, which is what ID3v2 uses for tag
+// sizes.
+func syncsafe(n int) []byte {
+	return []byte{
+		byte(n>>21) & 0x7f,
+		byte(n>>14) & 0x7f,
+		byte(n>>7) & 0x7f,
+		byte(n) & 0x7f,
+	}
+}
+
+// Prepends an ID3v2.3 tag containing a single user defined text frame (TXXX)
+// to the given mp3 data. Only ISO-8859-1 text is supported.
+func AddTag(data []byte, key, val string) []byte {
+	var frame bytes.Buffer
+	frame.WriteByte(0) // Text encoding: ISO-8859-1.
+	frame.WriteString(key)
+	frame.WriteByte(0)
+	frame.WriteString(val)
+
+	var tag bytes.Buffer
+	tag.WriteString("ID3")
+	tag.Write([]byte{3, 0}) // Version 2.3.0.
+	tag.WriteByte(0)        // Flags.
+	tag.Write(syncsafe(10 + frame.Len()))
+	tag.WriteString("TXXX")
+	binary.Write(&tag, binary.BigEndian, uint32(frame.Len()))
+	tag.Write([]byte{0, 0}) // Frame flags.
+	tag.Write(frame.Bytes())
+
+	return append(tag.Bytes(), data...)
+}
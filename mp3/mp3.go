@@ -4,109 +4,262 @@ import (
 	"bytes"
 	"encoding/binary"
 	"errors"
-	"hash/crc32"
 	"html"
 	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
+
+	"rsr/model"
 )
 
 var (
-	ErrNoMetaint         = errors.New("mp3: key 'icy-metaint' not found in HTTP header")
-	ErrCorruptedMetadata = errors.New("mp3: corrupted metadata")
-	ErrNoStreamTitle     = errors.New("mp3: no 'StreamTitle' tag in metadata")
+	ErrInvalidMetaint = errors.New("mp3: invalid 'icy-metaint' in HTTP header")
 )
 
+// Size of the blocks read from streams without metadata.
+const noMetadataBlockSize = 8192
+
 type Extractor struct {
-	metaint        int64 // Distance between two metadata chunks
+	metaint        int64 // Distance between two metadata chunks (0 if there is no metadata)
 	hasStreamTitle bool
-	streamTitle    string // Metadata tag determining the filename
+	rawTitle       string            // Stream title exactly as sent by the server
+	rawMetadata    string            // Last complete metadata string
+	fields         map[string]string // All fields of the last metadata string
+	changed        bool              // Whether the metadata changed since the last block
+	frames         frameCounter
+
+	// A title change is only reported once the new title has been around for
+	// at least this long, so titles flapping back and forth don't cause
+	// tiny tracks. Until then, the music data is held back.
+	debounce      time.Duration
+	pending       bool // Whether there is an unconfirmed title change.
+	pendingTitle  string
+	pendingRaw    string
+	pendingFields map[string]string
+	pendingSince  time.Time
+	held          bytes.Buffer // Music data held back since the title change.
+	heldSamples   int64
+	heldDuration  time.Duration
 }
 
-func NewExtractor(respHdr http.Header) (*Extractor, error) {
-	mi := respHdr.Get("icy-metaint")
-	if mi == "" {
-		return nil, ErrNoMetaint
+// `debounce` is the time a new stream title has to persist before it counts
+// as a new track (0 to split immediately). If the server doesn't send
+// 'icy-metaint', the stream has no metadata, so there are no track
+// boundaries and no metadata.
+func NewExtractor(respHdr http.Header, debounce time.Duration) (*Extractor, error) {
+	var miNum int64
+	if mi := respHdr.Get("icy-metaint"); mi != "" {
+		var err error
+		miNum, err = strconv.ParseInt(mi, 10, 64)
+		if err != nil || miNum <= 0 {
+			return nil, ErrInvalidMetaint
+		}
 	}
-	miNum, _ := strconv.ParseInt(mi, 10, 64)
 	return &Extractor{
-		metaint: miNum,
+		metaint:  miNum,
+		debounce: debounce,
 	}, nil
 }
 
-func (d *Extractor) ReadBlock(r io.Reader, w io.Writer) (isFirst bool, err error) {
+// Returns whether the stream contains ICY metadata.
+func (d *Extractor) HasMetadata() bool {
+	return d.metaint > 0
+}
+
+func (d *Extractor) ReadBlock(r io.Reader) (*model.Block, error) {
 	var musicData bytes.Buffer
+	block := new(model.Block)
 
-	// We want to write everything except the metadata to the output and to 
-	// musicData for calculating the checksum.
-	multi := io.MultiWriter(w, &musicData)
+	if d.metaint == 0 {
+		// Without metadata, everything is music data.
+		if _, err := io.CopyN(&musicData, r, noMetadataBlockSize); err != nil {
+			return nil, err
+		}
+		d.count(block, musicData.Bytes())
+		block.Data = musicData.Bytes()
+		return block, nil
+	}
 
 	// Read until the metadata chunk. The part that is read here is also what
 	// contains the actual mp3 music data.
-	io.CopyN(multi, r, d.metaint)
+	if _, err := io.CopyN(&musicData, r, d.metaint); err != nil {
+		return nil, err
+	}
+	d.count(block, musicData.Bytes())
 
 	// Read number of metadata blocks (blocks within this function are not what
 	// is meant with `ReadBlock()`).
 	var numBlocks uint8
-	err = binary.Read(r, binary.LittleEndian, &numBlocks)
+	if err := binary.Read(r, binary.LittleEndian, &numBlocks); err != nil {
+		return nil, err
+	}
 
-	// Whether this block is the beginning of a new track.
-	var isBOF bool
+	var err error
 
 	// Read metadata blocks.
 	if numBlocks > 0 {
-		// Metadata is only actually stored in the first metadata chunk
-		// of a given file. Therefore, every metadata chunk with more than 0
-		// blocks always marks the beginning of a file.
-		isBOF = true
-
 		// Each block is 16 bytes in size. Any excess bytes in the last block
-		// are set to '\0', which is great because the `string()` conversion
-		// function ignores null bytes. The whole string is escaped via HTML.
-		// Metadata format: k0='v0';k1='v1';
-		raw := make([]byte, numBlocks*16)
-		if _, err := r.Read(raw); err != nil {
-			return false, err
+		// are set to '\0'. The whole string is escaped via HTML.
+		raw := make([]byte, int(numBlocks)*16)
+		if _, err := io.ReadFull(r, raw); err != nil {
+			return nil, err
+		}
+		rawString := html.UnescapeString(strings.TrimRight(string(raw), "\x00"))
+
+		// Malformed metadata is no reason to give up on the stream, so we use
+		// whatever we could parse and report the error separately.
+		parsed, parseErr := ParseMetadata(rawString)
+		if parseErr != nil {
+			err = &model.MetadataError{Err: parseErr}
 		}
-		rawString := html.UnescapeString(string(raw))
-		for _, data := range strings.Split(rawString, ";") {
-			s := strings.Split(data, "=")
-			if len(s) == 2 {
-				if s[0] == "StreamTitle" {
-					d.hasStreamTitle = true
-					// Strip stream title's first and last character (single
-					// quotes).
-					t := s[1]
-					if len(t) < 2 {
-						return false, ErrCorruptedMetadata
-					}
-					t = t[1 : len(t)-1]
-					if t == "Unknown" {
-						// If there is no stream title, use format:
-						// Unknown_<crc32 checksum of first block>
-						sumStr := strconv.FormatInt(int64(crc32.ChecksumIEEE(musicData.Bytes())), 10)
-						d.streamTitle = "Unknown_" + sumStr
-					} else {
-						d.streamTitle = t
-					}
-				}
-			} else if len(s) != 1 {
-				return false, ErrCorruptedMetadata
+		fields := make(map[string]string, len(parsed))
+		for _, f := range parsed {
+			fields[f.Key] = f.Val
+		}
+
+		t, hasTitle := fields["StreamTitle"]
+		switch {
+		case !d.hasStreamTitle:
+			// The first metadata chunk always marks the beginning of a
+			// track. Without any title, the track is unknown.
+			if !hasTitle {
+				t = "Unknown"
 			}
+			d.setStreamTitle(t, rawString, fields)
+			block.Boundary = true
+		case !hasTitle:
+			// Only other tags were updated.
+			d.updateFields(rawString, fields)
+		case t == d.rawTitle:
+			// Many servers periodically re-send the current title, which is
+			// not a new track. If a title change is pending, the title
+			// flapped back and the change is dropped.
+			if d.pending {
+				d.dropPending(block)
+				d.releaseHeld(&musicData, block)
+			}
+			d.updateFields(rawString, fields)
+		case d.debounce == 0:
+			d.setStreamTitle(t, rawString, fields)
+			block.Boundary = true
+		case !d.pending || t != d.pendingTitle:
+			// Start (or restart) the debounce period for the new title.
+			if d.pending {
+				d.dropPending(block)
+			}
+			d.pending = true
+			d.pendingTitle = t
+			d.pendingSince = time.Now()
+			d.pendingRaw = rawString
+			d.pendingFields = fields
+		default:
+			d.pendingRaw = rawString
+			d.pendingFields = fields
 		}
-		if !d.hasStreamTitle {
-			return false, ErrNoStreamTitle
+	}
+
+	if d.pending {
+		// Fall back to the wall clock if the frames couldn't be decoded.
+		elapsed := d.heldDuration + block.Duration
+		if elapsed == 0 {
+			elapsed = time.Since(d.pendingSince)
 		}
+		if elapsed < d.debounce {
+			d.held.Write(musicData.Bytes())
+			d.heldSamples += block.Samples
+			d.heldDuration += block.Duration
+			block.Samples = 0
+			block.Duration = 0
+			return block, err
+		}
+
+		// The new title has been around long enough, so the track changed
+		// back when it first appeared.
+		d.pending = false
+		d.releaseHeld(&musicData, block)
+		d.setStreamTitle(d.pendingTitle, d.pendingRaw, d.pendingFields)
+		block.Boundary = true
+	}
+
+	block.Data = musicData.Bytes()
+	if d.changed {
+		d.changed = false
+		m := d.metadata()
+		block.Metadata = &m
+	}
+	return block, err
+}
+
+// Sets the block's timing according to the frames in `p`.
+func (d *Extractor) count(block *model.Block, p []byte) {
+	block.Samples, block.Duration = d.frames.count(p)
+	block.SampleRate = d.frames.sampleRate
+}
+
+// Puts the music data held back during a pending title change in front of
+// `musicData`, adding its length to the block's.
+func (d *Extractor) releaseHeld(musicData *bytes.Buffer, block *model.Block) {
+	d.held.Write(musicData.Bytes())
+	musicData.Reset()
+	musicData.Write(d.held.Bytes())
+	block.Samples += d.heldSamples
+	block.Duration += d.heldDuration
+	d.held.Reset()
+	d.heldSamples = 0
+	d.heldDuration = 0
+}
+
+// Updates the metadata of the current (or pending) title. Metadata that is
+// merely re-sent isn't a change.
+func (d *Extractor) updateFields(raw string, fields map[string]string) {
+	if d.pending {
+		d.pendingRaw = raw
+		d.pendingFields = fields
+	} else if raw != d.rawMetadata {
+		d.rawMetadata = raw
+		d.fields = fields
+		d.changed = true
 	}
+}
+
+// Sets the current stream title along with the metadata it came with.
+func (d *Extractor) setStreamTitle(t, raw string, fields map[string]string) {
+	d.hasStreamTitle = true
+	d.rawTitle = t
+	d.rawMetadata = raw
+	d.fields = fields
+	d.changed = true
+}
 
-	return isBOF, nil
+// Drops the unconfirmed title change, reporting it in the block.
+func (d *Extractor) dropPending(block *model.Block) {
+	d.pending = false
+	m := newMetadata(d.pendingTitle, d.pendingRaw, d.pendingFields)
+	block.Dropped = &m
 }
 
-func (d *Extractor) TryGetFilename() (filename string, hasFilename bool) {
-	if !d.hasStreamTitle {
-		return "", false
+// Returns the metadata of the current track.
+func (d *Extractor) metadata() model.Metadata {
+	return newMetadata(d.rawTitle, d.rawMetadata, d.fields)
+}
+
+func newMetadata(title, raw string, fields map[string]string) model.Metadata {
+	m := model.Metadata{
+		Fields: fields,
+		Raw:    raw,
+	}
+	// "Unknown" is what servers send when they don't know the title.
+	if title == "Unknown" || title == "" {
+		return m
+	}
+	// Most stations use the format "<artist> - <title>".
+	if i := strings.Index(title, " - "); i >= 0 {
+		m.Artist = title[:i]
+		m.Title = title[i+3:]
+	} else {
+		m.Title = title
 	}
-	base := strings.ReplaceAll(d.streamTitle, "/", "_") // Replace invalid characters.
-	return base + ".mp3", true
+	return m
 }
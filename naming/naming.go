@@ -0,0 +1,94 @@
+// Filename templates, e.g. "{show}/{date} {time}{ext}". Placeholders are
+// field names in curly braces; "{{" and "}}" stand for literal braces.
+// Slashes in the template create subdirectories, while slashes in the
+// substituted values are replaced, so a value can't escape its place.
+package naming
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrUnterminated = errors.New("naming: unterminated placeholder")
+	ErrUnknownField = errors.New("naming: unknown placeholder")
+)
+
+// Layouts of the date and time placeholders. The time of day doesn't contain
+// colons, as they aren't allowed in filenames on all systems.
+const (
+	DateLayout = "2006-01-02"
+	TimeLayout = "15-04"
+)
+
+type part struct {
+	literal string
+	field   string // Empty for literal text.
+}
+
+type Template struct {
+	src   string
+	parts []part
+}
+
+// Parses a template. Only the given field names are allowed as placeholders.
+func Parse(s string, fields ...string) (Template, error) {
+	known := make(map[string]bool, len(fields))
+	for _, f := range fields {
+		known[f] = true
+	}
+
+	t := Template{src: s}
+	var lit strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "{{"), strings.HasPrefix(s[i:], "}}"):
+			lit.WriteByte(s[i])
+			i++
+		case s[i] == '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				return Template{}, fmt.Errorf("%w in '%v'", ErrUnterminated, s)
+			}
+			name := s[i+1 : i+end]
+			if !known[name] {
+				return Template{}, fmt.Errorf("%w '{%v}' in '%v'", ErrUnknownField, name, s)
+			}
+			if lit.Len() > 0 {
+				t.parts = append(t.parts, part{literal: lit.String()})
+				lit.Reset()
+			}
+			t.parts = append(t.parts, part{field: name})
+			i += end
+		default:
+			lit.WriteByte(s[i])
+		}
+	}
+	if lit.Len() > 0 {
+		t.parts = append(t.parts, part{literal: lit.String()})
+	}
+	return t, nil
+}
+
+// Replaces characters that aren't allowed within a path component.
+func Sanitize(s string) string {
+	return strings.NewReplacer("/", "_", "\x00", "").Replace(s)
+}
+
+// Fills in the template. Missing values are left empty.
+func (t Template) Expand(vals map[string]string) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		if p.field == "" {
+			b.WriteString(p.literal)
+		} else {
+			b.WriteString(Sanitize(vals[p.field]))
+		}
+	}
+	return b.String()
+}
+
+func (t Template) String() string {
+	return t.src
+}
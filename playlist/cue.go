@@ -0,0 +1,83 @@
+// Playlists describing recordings: CUE sheets for continuous recordings and
+// M3U playlists of saved tracks.
+package playlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// A title within a continuous recording.
+type CueTrack struct {
+	Performer string
+	Title     string
+	Offset    time.Duration // Offset from the beginning of the file.
+}
+
+// A CUE sheet for a single audio file.
+type Cue struct {
+	Performer string // E.g. the station.
+	Title     string // E.g. the show.
+	File      string // Audio file, relative to the CUE sheet.
+	Tracks    []CueTrack
+}
+
+// Returns the CUE file type of an audio file. The CUE format only knows a
+// few types; players accept "WAVE" for any other audio format.
+func cueFileType(filename string) string {
+	if strings.EqualFold(path.Ext(filename), ".mp3") {
+		return "MP3"
+	}
+	return "WAVE"
+}
+
+// Quotes a CUE string. CUE has no way of escaping double quotes.
+func cueQuote(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, "'") + `"`
+}
+
+// Formats an offset as "MM:SS:FF", with 75 frames per second.
+func cueTime(d time.Duration) string {
+	frames := int64(d) * 75 / int64(time.Second)
+	return fmt.Sprintf("%02d:%02d:%02d", frames/(75*60), frames/75%60, frames%75)
+}
+
+func (c *Cue) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if c.Performer != "" {
+		fmt.Fprintf(bw, "PERFORMER %v\n", cueQuote(c.Performer))
+	}
+	if c.Title != "" {
+		fmt.Fprintf(bw, "TITLE %v\n", cueQuote(c.Title))
+	}
+	fmt.Fprintf(bw, "FILE %v %v\n", cueQuote(c.File), cueFileType(c.File))
+	for i, t := range c.Tracks {
+		fmt.Fprintf(bw, "  TRACK %02d AUDIO\n", i+1)
+		if t.Title != "" {
+			fmt.Fprintf(bw, "    TITLE %v\n", cueQuote(t.Title))
+		}
+		if t.Performer != "" {
+			fmt.Fprintf(bw, "    PERFORMER %v\n", cueQuote(t.Performer))
+		}
+		fmt.Fprintf(bw, "    INDEX 01 %v\n", cueTime(t.Offset))
+	}
+	return bw.Flush()
+}
+
+// Writes the CUE sheet to `filePath`.
+func (c *Cue) Write(filePath string) error {
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	if err := c.Encode(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,48 @@
+package playlist
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// An entry of an M3U playlist.
+type M3UEntry struct {
+	Path     string        // Relative to the playlist.
+	Title    string        // Shown instead of the path.
+	Duration time.Duration // Negative if unknown.
+}
+
+// Appends an entry to the extended M3U playlist at `filePath`, creating the
+// playlist if it doesn't exist yet. Playlists are always UTF-8 encoded, as
+// the ".m3u8" extension says.
+func AppendM3U(filePath string, e M3UEntry) error {
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	var b strings.Builder
+	if info.Size() == 0 {
+		b.WriteString("#EXTM3U\n")
+	}
+	secs := -1
+	if e.Duration >= 0 {
+		secs = int(e.Duration.Round(time.Second) / time.Second)
+	}
+	// Line breaks would end the entry early.
+	title := strings.NewReplacer("\r", " ", "\n", " ").Replace(e.Title)
+	fmt.Fprintf(&b, "#EXTINF:%v,%v\n%v\n", secs, title, e.Path)
+
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,265 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"rsr/model"
+	"rsr/naming"
+	"rsr/playlist"
+)
+
+// Placeholders allowed in archive filename templates.
+var archiveFields = []string{"station", "date", "time", "ext"}
+
+// Extension of a segment's index, which replaces the segment's extension.
+const ArchiveIndexExt = ".jsonl"
+
+// An entry of a segment's index, written whenever the metadata changes.
+type archiveIndexEntry struct {
+	Time    time.Time `json:"time"`
+	Offset  int64     `json:"offset"`  // Byte offset within the segment.
+	Seconds float64   `json:"seconds"` // Playback time since the segment's start.
+	Artist  string    `json:"artist,omitempty"`
+	Title   string    `json:"title,omitempty"`
+	Raw     string    `json:"raw_metadata,omitempty"`
+	// Whether the connection was lost right before this point.
+	Gap bool `json:"gap,omitempty"`
+}
+
+// Writes the whole stream into segments of a fixed length, aligned to the
+// wall clock, regardless of which tracks are saved. Segments are only cut on
+// frame (mp3) or page (Ogg) boundaries, see `recorder.cutPoint()`.
+type archiveWriter struct {
+	length   time.Duration
+	template naming.Template
+
+	file      *os.File
+	path      string
+	indexPath string
+	end       time.Time // End of the current segment's period.
+	size      int64
+	duration  time.Duration
+	cutting   bool      // Whether to cut at the next frame or page boundary.
+	failed    time.Time // Writing failed; retry with the next segment.
+	cue       playlist.Cue
+
+	meta       model.Metadata // Current metadata, repeated at each segment's start.
+	hasMeta    bool
+	boundary   int64 // Offsets of the last track boundary in the current segment.
+	boundaryAt time.Duration
+	gap        bool // Whether the connection was lost since the last block.
+}
+
+func newArchiveWriter(length time.Duration, template naming.Template) *archiveWriter {
+	return &archiveWriter{length: length, template: template}
+}
+
+// Returns the period containing `t`. Periods are aligned to local midnight,
+// so e.g. hourly segments start on the full hour.
+func (a *archiveWriter) period(t time.Time) (start, end time.Time) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	start = midnight.Add(t.Sub(midnight) / a.length * a.length)
+	end = start.Add(a.length)
+	if next := midnight.AddDate(0, 0, 1); end.After(next) {
+		end = next
+	}
+	return start, end
+}
+
+// Returns `p`, or if a file by that name already exists, the same name with
+// a number appended.
+func uniquePath(p string) string {
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	for i := 2; ; i++ {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			return p
+		}
+		p = fmt.Sprintf("%v (%v)%v", base, i, ext)
+	}
+}
+
+// Starts a new segment for the period containing `now`.
+func (rec *Recorder) openSegment(now time.Time) error {
+	a := rec.archive
+	start, end := a.period(now)
+	station := rec.Station()
+	filename := a.template.Expand(map[string]string{
+		"station": station,
+		"date":    start.Format(naming.DateLayout),
+		"time":    start.Format(naming.TimeLayout),
+		"ext":     rec.ext,
+	})
+	segPath := uniquePath(filepath.Join(rec.dir, filepath.FromSlash(filename)))
+	if err := os.MkdirAll(filepath.Dir(segPath), 0777); err != nil {
+		return err
+	}
+	f, err := os.Create(segPath)
+	if err != nil {
+		return err
+	}
+	a.file = f
+	a.path = segPath
+	a.indexPath = strings.TrimSuffix(segPath, filepath.Ext(segPath)) + ArchiveIndexExt
+	a.end = end
+	a.size = 0
+	a.duration = 0
+	a.boundary = 0
+	a.boundaryAt = 0
+	a.cue = playlist.Cue{
+		Performer: station,
+		Title:     strings.TrimSpace(station + " " + start.Format("2006-01-02 15:04")),
+		File:      filepath.Base(segPath),
+	}
+	rec.infof("Archiving stream to: %v", segPath)
+
+	// Make the index of each segment complete on its own.
+	if a.hasMeta {
+		rec.indexTitle(a.meta)
+	}
+	return nil
+}
+
+// Closes the current segment.
+func (rec *Recorder) closeSegment() {
+	a := rec.archive
+	if a.file == nil {
+		return
+	}
+	if err := a.file.Close(); err != nil {
+		rec.errorf("Error writing archive segment: %v", err)
+	} else {
+		rec.infof("Archived segment: %v (%v)", a.path, a.duration.Round(time.Second))
+	}
+	a.file = nil
+
+	cuePath := strings.TrimSuffix(a.path, filepath.Ext(a.path)) + ".cue"
+	if err := a.cue.Write(cuePath); err != nil {
+		rec.errorf("Error writing CUE sheet: %v", err)
+	}
+	a.cutting = false
+}
+
+// Appends an entry to the current segment's index.
+func (rec *Recorder) indexArchive(e archiveIndexEntry) {
+	a := rec.archive
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		rec.errorf("Error encoding archive index: %v", err)
+		return
+	}
+	f, err := os.OpenFile(a.indexPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		rec.errorf("Error writing archive index: %v", err)
+		return
+	}
+	_, err = f.Write(append(line, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		rec.errorf("Error writing archive index: %v", err)
+	}
+}
+
+// Writes data to the current segment, opening one if needed.
+func (rec *Recorder) writeSegment(p []byte, d time.Duration, now time.Time) {
+	a := rec.archive
+	if a.file == nil {
+		if now.Before(a.failed) {
+			return
+		}
+		if err := rec.openSegment(now); err != nil {
+			rec.errorf("Error creating archive segment: %v", err)
+			_, a.failed = a.period(now)
+			return
+		}
+		n, err := a.file.Write(rec.streamHeaders(p))
+		a.size += int64(n)
+		if err != nil {
+			rec.errorf("Error writing archive segment: %v", err)
+		}
+	}
+	n, err := a.file.Write(p)
+	a.size += int64(n)
+	a.duration += d
+	if err != nil {
+		rec.errorf("Error writing archive segment: %v", err)
+		rec.closeSegment()
+		_, a.failed = a.period(now)
+	}
+}
+
+// Archives a block of the stream. `isFirst` is set if the block starts a new
+// track.
+func (rec *Recorder) writeArchive(p []byte, d time.Duration, isFirst bool) {
+	a := rec.archive
+	now := time.Now()
+	if a.file != nil && !now.Before(a.end) {
+		a.cutting = true
+	}
+	if a.cutting {
+		if i := rec.cutPoint(p); i >= 0 {
+			// Split the duration by the share of bytes going to each segment.
+			d0 := d * time.Duration(i) / time.Duration(len(p))
+			rec.writeSegment(p[:i], d0, now)
+			rec.closeSegment()
+			p, d = p[i:], d-d0
+		}
+	}
+
+	if isFirst || a.gap {
+		if a.file == nil {
+			a.boundary, a.boundaryAt = 0, 0
+		} else {
+			a.boundary, a.boundaryAt = a.size, a.duration
+		}
+	}
+	gap := a.gap
+	a.gap = false
+	rec.writeSegment(p, d, now)
+	if gap && a.file != nil {
+		rec.indexArchive(archiveIndexEntry{
+			Offset:  a.boundary,
+			Seconds: a.boundaryAt.Seconds(),
+			Gap:     true,
+		})
+	}
+}
+
+// Adds a metadata change to the index. The change is placed at the last
+// track boundary, as the metadata usually becomes known a little later.
+func (rec *Recorder) archiveTitle(m model.Metadata) {
+	a := rec.archive
+	a.meta = m
+	a.hasMeta = true
+	if a.file == nil {
+		return
+	}
+	rec.indexTitle(m)
+}
+
+// Adds a title to the current segment's index and CUE sheet.
+func (rec *Recorder) indexTitle(m model.Metadata) {
+	a := rec.archive
+	rec.indexArchive(archiveIndexEntry{
+		Offset:  a.boundary,
+		Seconds: a.boundaryAt.Seconds(),
+		Artist:  m.Artist,
+		Title:   m.Title,
+		Raw:     m.Raw,
+	})
+	a.cue.Tracks = append(a.cue.Tracks, playlist.CueTrack{
+		Performer: m.Artist,
+		Title:     m.Title,
+		Offset:    a.boundaryAt,
+	})
+}
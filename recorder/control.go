@@ -0,0 +1,246 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrShow = errors.New("recorder: not possible while recording a show")
+
+// What a recorder is doing, see `Status`.
+type State string
+
+const (
+	StateIdle       State = "idle" // Waiting for a recording window.
+	StateConnecting State = "connecting"
+	StateRecording  State = "recording"
+	StatePaused     State = "paused"    // See `Recorder.Pause()`.
+	StateLowSpace   State = "low_space" // Paused until there is enough free space.
+	StateStopped    State = "stopped"   // `Run()` returned.
+)
+
+// A snapshot of what a recorder is doing, see `Recorder.Status()`.
+type Status struct {
+	Station        string     `json:"station,omitempty"`
+	URL            string     `json:"url"`
+	State          State      `json:"state"`
+	Connected      bool       `json:"connected"`
+	ConnectedSince *time.Time `json:"connected_since,omitempty"`
+	Title          string     `json:"title,omitempty"` // Of the track being recorded.
+	Filename       string     `json:"filename,omitempty"`
+	BytesReceived  int64      `json:"bytes_received"`
+	BlocksRead     int64      `json:"blocks_read"` // Frames (mp3) or pages (Ogg).
+
+	TracksSaved     int `json:"tracks_saved"`
+	TracksDiscarded int `json:"tracks_discarded"`
+	TracksFailed    int `json:"tracks_failed"`
+	// When the last track was saved.
+	LastTrackSaved *time.Time `json:"last_track_saved,omitempty"`
+
+	// Reconnects by reason: "connect_error", "end_of_stream", "read_error"
+	// or "checksum_error" (of an Ogg page).
+	Reconnects        map[string]int `json:"reconnects,omitempty"`
+	OggChecksumErrors int            `json:"ogg_checksum_errors"`
+	MetadataErrors    int            `json:"metadata_errors"` // Malformed ICY metadata.
+
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+}
+
+// Requests made from other goroutines, handled by the goroutine running
+// `Run()` with the next block received.
+type controls struct {
+	paused  bool
+	split   bool
+	skip    bool
+	resumed chan struct{} // Signaled by `Resume()`.
+}
+
+// Returns what the recorder is doing. Safe to call from any goroutine.
+func (rec *Recorder) Status() Status {
+	rec.statusMu.Lock()
+	defer rec.statusMu.Unlock()
+	s := rec.status
+	s.Station = rec.Station()
+	s.URL = rec.url
+	if s.Reconnects != nil {
+		s.Reconnects = make(map[string]int, len(rec.status.Reconnects))
+		for k, v := range rec.status.Reconnects {
+			s.Reconnects[k] = v
+		}
+	}
+	return s
+}
+
+func (rec *Recorder) setState(s State) {
+	rec.statusMu.Lock()
+	rec.status.State = s
+	rec.statusMu.Unlock()
+}
+
+// Updates the status according to an event.
+func (rec *Recorder) updateStatus(e Event) {
+	rec.statusMu.Lock()
+	defer rec.statusMu.Unlock()
+	s := &rec.status
+	switch e.Type {
+	case Connected:
+		s.Connected = true
+		s.ConnectedSince = &e.Time
+	case Disconnected:
+		s.Connected = false
+		s.ConnectedSince = nil
+		s.Title, s.Filename = "", ""
+	case TrackStarted:
+		s.Title = e.Metadata.Artist
+		if e.Metadata.Title != "" {
+			if s.Title != "" {
+				s.Title += " - "
+			}
+			s.Title += e.Metadata.Title
+		}
+		s.Filename = e.Filename
+	case TrackSaved:
+		s.TracksSaved++
+		s.LastTrackSaved = &e.Time
+	case TrackDiscarded:
+		s.TracksDiscarded++
+	case TrackFailed:
+		s.TracksFailed++
+	}
+	if e.Err != nil {
+		s.LastError = e.Err.Error()
+		s.LastErrorTime = &e.Time
+	}
+}
+
+// Marks the connection as closed, e.g. when recording pauses or stops.
+func (rec *Recorder) disconnected() {
+	rec.statusMu.Lock()
+	rec.status.Connected = false
+	rec.status.ConnectedSince = nil
+	rec.status.Title, rec.status.Filename = "", ""
+	rec.statusMu.Unlock()
+}
+
+func (rec *Recorder) countBlock(n int) {
+	rec.statusMu.Lock()
+	rec.status.BytesReceived += int64(n)
+	rec.status.BlocksRead++
+	rec.statusMu.Unlock()
+}
+
+func (rec *Recorder) countMetadataError() {
+	rec.statusMu.Lock()
+	rec.status.MetadataErrors++
+	rec.statusMu.Unlock()
+}
+
+// Counts a reconnect, see `Status.Reconnects`.
+func (rec *Recorder) countReconnect(reason string) {
+	rec.statusMu.Lock()
+	defer rec.statusMu.Unlock()
+	if rec.status.Reconnects == nil {
+		rec.status.Reconnects = make(map[string]int)
+	}
+	rec.status.Reconnects[reason]++
+	if reason == "checksum_error" {
+		rec.status.OggChecksumErrors++
+	}
+}
+
+// Pauses recording: The track being recorded is discarded and the
+// connection is closed until `Resume()` is called. Takes effect with the
+// next data received. A show continues in the same file after resuming.
+func (rec *Recorder) Pause() {
+	rec.ctlMu.Lock()
+	rec.ctl.paused = true
+	rec.ctlMu.Unlock()
+}
+
+// Resumes recording after `Pause()`.
+func (rec *Recorder) Resume() {
+	rec.ctlMu.Lock()
+	rec.ctl.paused = false
+	rec.ctlMu.Unlock()
+	select {
+	case rec.ctl.resumed <- struct{}{}:
+	default:
+	}
+}
+
+// Ends the track being recorded at the next frame or page boundary and
+// starts a new one, named after the time like tracks split by time.
+func (rec *Recorder) Split() error {
+	if rec.show != nil {
+		return ErrShow
+	}
+	rec.ctlMu.Lock()
+	rec.ctl.split = true
+	rec.ctlMu.Unlock()
+	return nil
+}
+
+// Discards the track being recorded. Recording continues with the next
+// track.
+func (rec *Recorder) Skip() error {
+	if rec.show != nil {
+		return ErrShow
+	}
+	rec.ctlMu.Lock()
+	rec.ctl.skip = true
+	rec.ctlMu.Unlock()
+	return nil
+}
+
+// Returns the pending requests, resetting the ones that are done once
+// they're handled.
+func (rec *Recorder) takeRequests() (paused, split, skip bool) {
+	rec.ctlMu.Lock()
+	defer rec.ctlMu.Unlock()
+	paused, split, skip = rec.ctl.paused, rec.ctl.split, rec.ctl.skip
+	rec.ctl.split, rec.ctl.skip = false, false
+	return paused, split, skip
+}
+
+// Waits while recording is paused.
+func (rec *Recorder) waitWhilePaused(ctx context.Context) {
+	logged := false
+	for {
+		rec.ctlMu.Lock()
+		paused := rec.ctl.paused
+		rec.ctlMu.Unlock()
+		if !paused {
+			if logged {
+				rec.infof("Resuming recording")
+			}
+			return
+		}
+		if !logged {
+			rec.infof("Recording paused")
+			rec.setState(StatePaused)
+			logged = true
+		}
+		select {
+		case <-rec.ctl.resumed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Discards the track being recorded.
+func (rec *Recorder) skipTrack() {
+	t := rec.cur
+	if t.skip || t.discard {
+		return
+	}
+	if t.hasFilename {
+		rec.trackLog(t.filename).Infof("Skipping track: %v", t.filename)
+	}
+	t.skip = true
+	t.skipReason = "skipped"
+	t.data = bytes.Buffer{}
+}
@@ -0,0 +1,922 @@
+package recorder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"rsr/catalog"
+	"rsr/filter"
+	"rsr/history"
+	"rsr/model"
+	"rsr/mp3"
+	"rsr/naming"
+	"rsr/playlist"
+	"rsr/sidecar"
+	"rsr/sink"
+	"rsr/util"
+	"rsr/vorbis"
+)
+
+// State of a single track being recorded.
+type track struct {
+	filename    string
+	hasFilename bool
+	path        string // Where the track was saved on the local file system.
+	meta        model.Metadata
+	data        bytes.Buffer
+	len         int // Number of bytes read, including those that weren't buffered.
+	start, end  time.Time
+	duration    time.Duration
+
+	// Whether this is the first track after connecting. Streams usually
+	// don't start at the exact end of a track, meaning it is almost certainly
+	// going to be incomplete.
+	first bool
+	// First tracks are discarded, unless the `-keep-first` option is given.
+	discard bool
+	// Whether the track is not going to be saved for another reason, e.g.
+	// because it is excluded by a filter.
+	skip       bool
+	skipReason string
+	// Size and duration (if known) of a previous recording of the track, if
+	// there is one and we're only replacing it with a longer take.
+	knownSize     int
+	knownDuration time.Duration
+	isKnown       bool
+
+	// Padding taken from before the track's start and after its end.
+	preRoll, postRoll time.Duration
+
+	gap   bool // Whether the connection was lost and resumed within the track.
+	timed bool // Whether the track was split by time rather than by metadata.
+	// Why the track is incomplete, e.g. because it was cut off by a lost
+	// connection. Empty if it is complete (as far as we know).
+	partialReason string
+}
+
+// Appends a block of music data with the given playback duration.
+func (t *track) append(p []byte, d time.Duration) {
+	now := time.Now()
+	if t.len == 0 {
+		t.start = now
+	}
+	t.end = now
+	t.len += len(p)
+	t.duration += d
+	if !t.skip {
+		t.data.Write(p)
+	}
+}
+
+// Appends another (unnamed) track, e.g. the data received after reconnecting.
+func (t *track) appendTrack(o *track) {
+	if t.len == 0 {
+		t.start = o.start
+	}
+	t.end = o.end
+	t.len += o.len
+	t.duration += o.duration
+	if !t.skip {
+		t.data.Write(o.data.Bytes())
+	}
+}
+
+// A track that ended, but is still receiving its post-roll.
+type endingTrack struct {
+	t    *track
+	left time.Duration // Post-roll still to be appended.
+}
+
+// Decides whether a track should be saved according to the include/exclude
+// rules.
+func (rec *Recorder) filterTrack(m model.Metadata) (save bool, reason string) {
+	rules := rec.opts.Rules
+	if f := rec.opts.RulesFile; f != nil {
+		fileRules, reloaded, err := f.Rules()
+		if err != nil {
+			rec.errorf("Error reloading filter rules: %v", err)
+		} else if reloaded {
+			rec.infof("Reloaded filter rules from %v", f.Path())
+		}
+		rules = append(append(filter.Rules{}, rules...), fileRules...)
+	}
+	return rules.Match(m)
+}
+
+// Checks whether a track was already recorded, either according to the
+// catalog or because a file with the same name exists. Returns the size of the
+// largest previous recording, and its duration if the catalog knows it.
+func (rec *Recorder) lookupTrack(filename string, m model.Metadata) (size int, d time.Duration, found bool) {
+	if e, ok := rec.catalog.Lookup(m.Artist, m.Title); ok {
+		size, found = e.Size, true
+		d = time.Duration(e.Duration * float64(time.Second))
+	}
+	if info, err := os.Stat(path.Join(rec.dir, filename)); err == nil {
+		if !found || int(info.Size()) > size {
+			size = int(info.Size())
+		}
+		found = true
+	}
+	return size, d, found
+}
+
+// Reports whether a track is longer than its previous recording. Padding
+// doesn't count, so only durations are compared, unless the previous
+// recording's duration is unknown.
+func (t *track) longerThanKnown() bool {
+	if t.knownDuration > 0 {
+		return t.unpadded() > t.knownDuration
+	}
+	return t.len > t.knownSize
+}
+
+// Returns the track's duration without pre-roll and post-roll.
+func (t *track) unpadded() time.Duration {
+	return t.duration - t.preRoll - t.postRoll
+}
+
+// Returns the filename of a track with the metadata `m`. `block` is the
+// block the metadata came with, which tells apart tracks without a title.
+func (rec *Recorder) trackFilename(m model.Metadata, block []byte) string {
+	var base string // Filename without extension.
+	switch {
+	case m.Artist == "" && m.Title == "":
+		base = "Unknown_" + strconv.FormatInt(int64(crc32.ChecksumIEEE(block)), 10)
+	case rec.ext == ".ogg":
+		// Ogg/Vorbis tracks have always been named "<ARTIST> -- <TITLE>",
+		// keep it that way so earlier recordings are still recognized.
+		artist, title := m.Artist, m.Title
+		if artist == "" {
+			artist = "Unknown"
+		} else if title == "" {
+			title = "Unknown"
+		}
+		base = artist + " -- " + title
+	case m.Artist == "":
+		base = m.Title
+	default:
+		base = m.Artist + " - " + m.Title
+	}
+	return naming.Sanitize(base) + rec.ext
+}
+
+// Inserts the partial track suffix before the file extension.
+func (rec *Recorder) partialFilename(filename string) string {
+	ext := path.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + rec.opts.PartialSuffix + ext
+}
+
+// Adds a "PARTIAL=1" tag to the track data, if the format supports it.
+func tagPartial(filename string, data []byte) ([]byte, error) {
+	switch path.Ext(filename) {
+	case ".mp3":
+		return mp3.AddTag(data, "PARTIAL", "1"), nil
+	case ".ogg":
+		return vorbis.AddComment(data, "PARTIAL", "1")
+	}
+	return data, nil
+}
+
+// An error that reconnecting won't fix.
+type fatalError struct {
+	err error
+}
+
+func (e fatalError) Error() string { return e.err.Error() }
+func (e fatalError) Unwrap() error { return e.err }
+
+// Connects to the stream and sets up the extractor matching its content type.
+func (rec *Recorder) connect(ctx context.Context) (*http.Response, model.Extractor, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rec.url, nil)
+	if err != nil {
+		return nil, nil, fatalError{fmt.Errorf("HTTP request error: %w", err)}
+	}
+	req.Header.Add("Icy-MetaData", "1") // Request metadata for icecast mp3 streams.
+	rec.debugf("Connecting to %v", rec.url)
+	resp, err := rec.opts.Client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("HTTP error: %w", err)
+	}
+	rec.debugf("Response: %v", resp.Status)
+
+	var extractor model.Extractor
+
+	// Set up extractor depending on content type.
+	contentType := resp.Header.Get("content-type")
+	err = nil
+	switch contentType {
+	case "application/ogg", "audio/ogg", "audio/vorbis", "audio/vorbis-config":
+		extractor, err = vorbis.NewExtractor()
+		rec.ext = ".ogg"
+		rec.noMetadata = false
+	case "audio/mpeg", "audio/MPA", "audio/mpa-robust":
+		var mp3Extractor *mp3.Extractor
+		mp3Extractor, err = mp3.NewExtractor(resp.Header, rec.debounce)
+		if err == nil {
+			extractor = mp3Extractor
+			rec.noMetadata = !mp3Extractor.HasMetadata()
+		}
+		rec.ext = ".mp3"
+	default:
+		err = fmt.Errorf(`%w: '%v', supported formats:
+    Ogg/Vorbis ('application/ogg', 'audio/ogg', 'audio/vorbis', 'audio/vorbis-config')
+    mp3 ('audio/mpeg', 'audio/MPA', 'audio/mpa-robust')`, ErrUnsupportedType, contentType)
+	}
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, fatalError{err}
+	}
+
+	rec.infof("Stream type: '%v'", contentType)
+
+	rec.station = resp.Header.Get("icy-name")
+	if rec.station != "" {
+		rec.infof("Station: %v", rec.station)
+	}
+
+	return resp, extractor, nil
+}
+
+// Records the stream until the connection is lost or `ctx` is done. State
+// belonging to the current track is kept in `rec`, so calling `record()` again
+// continues where it left off as far as possible. Only returns errors that
+// reconnecting won't fix.
+func (rec *Recorder) record(ctx context.Context) error {
+	rec.waitWhilePaused(ctx)
+	if err := rec.waitForSpace(ctx); err != nil || ctx.Err() != nil {
+		return err
+	}
+
+	rec.setState(StateConnecting)
+	resp, extractor, err := rec.connect(ctx)
+	var fatal fatalError
+	if ctx.Err() != nil {
+		return nil
+	} else if errors.As(err, &fatal) || (err != nil && !rec.connected) {
+		return err
+	} else if err != nil {
+		rec.errorf("%v", err)
+		rec.emit(Event{Type: ConnectFailed, Err: err})
+		rec.failures++
+		if max := rec.opts.Reconnect.MaxAttempts; max > 0 && rec.failures >= max {
+			rec.emit(Event{Type: GaveUp, Err: err})
+			return fmt.Errorf("%w after %v attempts: %v", ErrGaveUp, rec.failures, err)
+		}
+		rec.countReconnect("connect_error")
+		rec.infof("Reconnecting in %v", rec.opts.Reconnect.Delay)
+		select {
+		case <-time.After(rec.opts.Reconnect.Delay):
+		case <-ctx.Done():
+		}
+		return nil
+	}
+	defer resp.Body.Close()
+	defer rec.disconnected()
+	if rec.archive != nil && rec.connected {
+		rec.archive.gap = true
+	}
+	rec.connected = true
+	rec.failures = 0
+	rec.setState(StateRecording)
+	rec.emit(Event{Type: Connected})
+	rec.takeRequests() // Requests about the previous connection's tracks.
+	rec.splitRequested = false
+
+	// Make reader blocking.
+	r := util.NewWaitReader(resp.Body)
+
+	// The data received before reconnecting doesn't belong in front of
+	// anything received now.
+	rec.recent.reset()
+
+	rec.titled = false
+	rec.sinceTitle = 0
+	rec.newTitle = true
+
+	// See `track.first`.
+	rec.cur = &track{first: true, discard: !rec.opts.KeepFirst}
+	if rec.opts.KeepFirst {
+		rec.cur.partialReason = "first track after connecting"
+	}
+
+	for {
+		block, err := extractor.ReadBlock(r)
+		var metaErr *model.MetadataError
+		if errors.As(err, &metaErr) {
+			// The music data is fine, so just keep going.
+			rec.warnf("%v", err)
+			rec.countMetadataError()
+		} else if ctx.Err() != nil {
+			// Recording was stopped.
+			return nil
+		} else if err != nil {
+			rec.errorf("Error reading block: %v", err)
+			rec.emit(Event{Type: Disconnected, Err: err})
+			rec.countReconnect(readErrorReason(err))
+			rec.interrupt()
+			// Reconnect, because this error is usually caused by a
+			// file corruption or a network error.
+			rec.infof("Reconnecting due to previous error")
+			return nil
+		}
+		rec.countBlock(len(block.Data))
+
+		paused, split, skip := rec.takeRequests()
+		if paused {
+			// Disconnect until recording is resumed.
+			rec.drop("recording paused")
+			return nil
+		}
+		if rec.spaceRanOut() {
+			// Disconnect until there is enough space again.
+			rec.drop("low disk space")
+			return nil
+		}
+		if skip && rec.show == nil {
+			rec.skipTrack()
+		}
+		if split && rec.show == nil && rec.cur.len > 0 {
+			rec.splitRequested = true
+		}
+
+		if rec.ext == ".ogg" {
+			rec.headers.Add(block.Data)
+		}
+		if rec.opts.History {
+			rec.logTitle(block)
+		}
+		if rec.archive != nil {
+			rec.writeArchive(block.Data, block.Duration, block.Boundary)
+		}
+
+		if rec.show != nil {
+			// Track boundaries only matter for the show's CUE sheet.
+			rec.appendShow(block)
+			continue
+		}
+
+		// We only care about the beginning of a new file when it marks an old
+		// file's end, which is not the case in the beginning of the first
+		// file.
+		isBoundary := block.Boundary && rec.cur.len > 0
+		before := rec.cur
+		p, d := block.Data, block.Duration
+		if block.Metadata != nil && block.Metadata.Title != "" {
+			rec.titled = true
+		}
+		rec.updateSplitMode(isBoundary, d)
+
+		if isBoundary {
+			if rec.interrupted != nil {
+				// We never found out whether the stream resumed with the
+				// interrupted track.
+				rec.finishInterrupted()
+			}
+			newStream := rec.ext == ".ogg" && vorbis.IsBOS(p)
+			if newStream {
+				// The pages of another logical stream can't be decoded with
+				// this one's headers, so Ogg tracks get no padding across
+				// stream boundaries.
+				rec.finishEnding()
+			}
+			if rec.postRoll > 0 && !newStream {
+				// Keep appending to the track until it has its post-roll.
+				rec.ending = append(rec.ending, endingTrack{t: rec.cur, left: rec.postRoll})
+				rec.cur = rec.newTrack()
+			} else if rec.finishTrack(rec.cur) {
+				if newStream {
+					rec.cur = new(track)
+				} else {
+					rec.cur = rec.newTrack()
+				}
+			}
+		}
+
+		if rec.timeSplit {
+			p, d = rec.splitByTime(p, d)
+		}
+		if rec.splitRequested && rec.cur != before {
+			// The track just ended anyway.
+			rec.splitRequested = false
+		} else if rec.splitRequested {
+			var ok bool
+			if p, d, ok = rec.cut(p, d); ok {
+				rec.splitRequested = false
+				rec.nameByTime()
+			}
+		}
+
+		// Try to find out the current track's filename.
+		if !rec.cur.hasFilename {
+			if rec.timeSplit {
+				rec.nameByTime()
+			} else {
+				rec.resolveFilename(block)
+			}
+		}
+
+		// Append block to the current file byte buffer.
+		rec.cur.append(p, d)
+		rec.appendPostRoll(p, d)
+		rec.recent.push(p, d)
+	}
+}
+
+// Returns why reading a block failed, as counted in `Status.Reconnects`.
+func readErrorReason(err error) string {
+	switch {
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "end_of_stream"
+	case errors.Is(err, vorbis.ErrOggInvalidChecksum):
+		return "checksum_error"
+	}
+	return "read_error"
+}
+
+// Returns a new track, starting with the pre-roll.
+func (rec *Recorder) newTrack() *track {
+	t := new(track)
+	for _, b := range rec.recent.last(rec.preRoll) {
+		t.append(b.data, b.duration)
+		t.preRoll += b.duration
+	}
+	return t
+}
+
+// Appends a block to the tracks that ended, and saves the tracks that
+// received their full post-roll.
+func (rec *Recorder) appendPostRoll(p []byte, d time.Duration) {
+	n := 0
+	for _, e := range rec.ending {
+		e.t.append(p, d)
+		e.t.postRoll += d
+		e.left -= d
+		if e.left > 0 {
+			rec.ending[n] = e
+			n++
+		} else {
+			rec.finishTrack(e.t)
+		}
+	}
+	rec.ending = rec.ending[:n]
+}
+
+// Saves the tracks that ended without waiting for the rest of their
+// post-roll.
+func (rec *Recorder) finishEnding() {
+	for _, e := range rec.ending {
+		rec.finishTrack(e.t)
+	}
+	rec.ending = nil
+}
+
+// Names the current track once its metadata is known and decides what to do
+// with the track.
+func (rec *Recorder) resolveFilename(block *model.Block) {
+	if block.Metadata == nil {
+		return
+	}
+	f := rec.trackFilename(*block.Metadata, block.Data)
+	rec.debugf("Metadata: artist '%v', title '%v', album '%v'",
+		block.Metadata.Artist, block.Metadata.Title, block.Metadata.Album)
+
+	if it := rec.interrupted; it != nil {
+		rec.interrupted = nil
+		if it.hasFilename && it.filename == f {
+			// The stream resumed with the same track, so we continue
+			// recording it.
+			rec.trackLog(f).Infof("Resuming track after reconnecting: %v", f)
+			it.gap = true
+			it.appendTrack(rec.cur)
+			rec.cur = it
+			return
+		}
+		rec.interrupted = it
+		rec.finishInterrupted()
+	}
+
+	t := rec.cur
+	t.meta = *block.Metadata
+	t.filename = f
+	t.hasFilename = true
+	if rec.archive != nil {
+		rec.archiveTitle(t.meta)
+	}
+
+	save, reason := rec.filterTrack(t.meta)
+	if !t.discard && save && rec.catalog != nil && (rec.opts.SkipExisting || rec.opts.RerecordIfLonger) {
+		t.knownSize, t.knownDuration, t.isKnown = rec.lookupTrack(f, t.meta)
+	}
+	if t.discard {
+		rec.trackLog(f).Infof("Discarding track: %v", f)
+	} else if !save {
+		rec.trackLog(f).Infof("Excluding track: %v (%v)", f, reason)
+		t.skip = true
+		t.skipReason = "excluded, " + reason
+	} else if t.isKnown && rec.opts.SkipExisting {
+		rec.trackLog(f).Infof("Skipping track already in archive: %v", f)
+		t.skip = true
+		t.skipReason = "already in archive"
+	}
+	if t.discard {
+		return
+	} else if t.skip {
+		// Drop the pre-roll, which is all we buffered until now.
+		t.data = bytes.Buffer{}
+	} else if t.isKnown {
+		rec.trackLog(f).Infof("Recording track again: %v", f)
+		rec.trackStarted(t)
+	} else {
+		rec.trackLog(f).Infof("Recording track: %v", f)
+		rec.trackStarted(t)
+	}
+}
+
+// Called when recording stops. If partial tracks are being kept or
+// `keepLast` is set, the track being recorded is saved. A track that was
+// interrupted by a lost connection is saved if the `-interrupted` policy says
+// so. A show is always saved, as is the archive segment being written.
+func (rec *Recorder) stop(keepLast bool) {
+	if rec.archive != nil {
+		rec.closeSegment()
+	}
+	if rec.show != nil {
+		rec.finishShow()
+		return
+	}
+	rec.finishEnding()
+	if rec.interrupted != nil {
+		rec.finishInterrupted()
+	}
+	t := rec.cur
+	rec.cur = nil
+	if t == nil || t.len == 0 {
+		return
+	}
+	if t.discard || t.skip {
+		rec.finishTrack(t)
+		return
+	}
+	if !(rec.opts.KeepFirst || keepLast) {
+		rec.trackDone(t, "", "recording stopped", nil)
+		return
+	}
+	t.partialReason = "recording stopped"
+	rec.finishTrack(t)
+}
+
+// Drops the tracks being recorded when recording pauses, e.g. for lack of
+// space, since there's no telling when it resumes. The archive segment is
+// closed, while a show is continued once recording resumes.
+func (rec *Recorder) drop(reason string) {
+	rec.finishEnding()
+	if rec.interrupted != nil {
+		rec.finishInterrupted()
+	}
+	if t := rec.cur; t != nil && t.len > 0 {
+		if t.discard || t.skip {
+			rec.finishTrack(t)
+		} else {
+			if t.hasFilename {
+				rec.trackLog(t.filename).Infof("Discarding track: %v (%v)", t.filename, reason)
+			}
+			rec.trackDone(t, "", reason, nil)
+		}
+	}
+	rec.cur = nil
+	if rec.archive != nil {
+		rec.closeSegment()
+	}
+}
+
+// Called when the connection is lost.
+func (rec *Recorder) interrupt() {
+	rec.finishEnding()
+	t := rec.cur
+	rec.cur = nil
+	if t == nil || t.len == 0 {
+		return
+	}
+	if rec.interrupted != nil {
+		if !t.hasFilename {
+			// We still don't know whether the stream resumed with the
+			// interrupted track.
+			return
+		}
+		rec.finishInterrupted()
+	}
+	rec.interrupted = t
+}
+
+// Saves or discards the interrupted track, depending on the
+// `-interrupted` policy.
+func (rec *Recorder) finishInterrupted() {
+	t := rec.interrupted
+	rec.interrupted = nil
+	if !t.hasFilename {
+		return
+	}
+	if t.discard || t.skip {
+		rec.finishTrack(t)
+		return
+	}
+	if !rec.opts.SaveInterrupted {
+		rec.trackLog(t.filename).Infof("Discarding interrupted track: %v", t.filename)
+		rec.trackDone(t, "", "interrupted by a lost connection", nil)
+		return
+	}
+	t.partialReason = "interrupted by a lost connection"
+	rec.finishTrack(t)
+}
+
+func (rec *Recorder) trackStarted(t *track) {
+	rec.emit(Event{
+		Type:     TrackStarted,
+		Filename: t.filename,
+		Metadata: t.meta,
+	})
+}
+
+// Reports what happened to a track: It was saved as `filename`, or it wasn't
+// saved because of `reason` or `err`. Also adds the result to the station's
+// history log, unless the track was split by time and so isn't about a title
+// at all.
+func (rec *Recorder) trackDone(t *track, filename, reason string, err error) {
+	if !t.hasFilename {
+		return
+	}
+	e := Event{
+		Type:     TrackDiscarded,
+		Filename: t.filename,
+		Metadata: t.meta,
+		Duration: t.duration,
+		Size:     t.data.Len(),
+		Reason:   reason,
+		Err:      err,
+	}
+	if filename != "" {
+		e.Type = TrackSaved
+		e.Filename = filename
+		e.Path = t.path
+	} else if err != nil {
+		e.Type = TrackFailed
+	}
+	rec.emit(e)
+
+	if !rec.opts.History || t.timed {
+		return
+	}
+	if err != nil {
+		reason = err.Error()
+	}
+	rec.appendHistory(history.Entry{
+		Time:        time.Now(),
+		Kind:        history.Result,
+		Station:     rec.Station(),
+		Artist:      t.meta.Artist,
+		Title:       t.meta.Title,
+		RawMetadata: t.meta.Raw,
+		Saved:       filename != "",
+		Filename:    filename,
+		Reason:      reason,
+	})
+}
+
+// Adds the titles appearing, changing or being dropped in a block to the
+// station's history log.
+func (rec *Recorder) logTitle(block *model.Block) {
+	if block.Boundary {
+		rec.newTitle = true
+	}
+	// All of the block's audio is from after the change, which includes any
+	// audio held back while debouncing the title.
+	at := time.Now().Add(-block.Duration)
+	entry := func(kind string, m model.Metadata) history.Entry {
+		return history.Entry{
+			Time:        at,
+			Kind:        kind,
+			Station:     rec.Station(),
+			Artist:      m.Artist,
+			Title:       m.Title,
+			RawMetadata: m.Raw,
+		}
+	}
+	if m := block.Dropped; m != nil {
+		e := entry(history.Dropped, *m)
+		e.Time = time.Now()
+		e.Reason = "didn't persist for the debounce time"
+		rec.appendHistory(e)
+	}
+	if m := block.Metadata; m != nil {
+		kind := history.Update
+		if rec.newTitle {
+			kind = history.Title
+			rec.newTitle = false
+		}
+		rec.appendHistory(entry(kind, *m))
+	}
+}
+
+func (rec *Recorder) appendHistory(e history.Entry) {
+	name := rec.Station()
+	if name == "" {
+		name = "stream"
+	}
+	p := filepath.Join(rec.dir, naming.Sanitize(name)+history.Ext)
+	if err := history.Append(p, e); err != nil {
+		rec.errorf("Error writing history log: %v", err)
+	}
+}
+
+// Returns the title of a track as shown in playlists.
+func trackTitle(t *track) string {
+	switch {
+	case t.meta.Artist != "" && t.meta.Title != "":
+		return t.meta.Artist + " - " + t.meta.Title
+	case t.meta.Title != "":
+		return t.meta.Title
+	}
+	return strings.TrimSuffix(t.filename, path.Ext(t.filename))
+}
+
+// Adds a saved file to the station's playlist of the day the recording
+// started on.
+func (rec *Recorder) addToPlaylist(filePath, title string, d time.Duration, start time.Time) {
+	name := rec.Station()
+	if name == "" {
+		name = "Playlist"
+	}
+	playlistPath := filepath.Join(rec.dir, naming.Sanitize(name)+" "+start.Format(naming.DateLayout)+".m3u8")
+	rel, err := filepath.Rel(rec.dir, filePath)
+	if err != nil {
+		rel = filePath
+	}
+	err = playlist.AppendM3U(playlistPath, playlist.M3UEntry{
+		Path:     filepath.ToSlash(rel),
+		Title:    title,
+		Duration: d,
+	})
+	if err != nil {
+		rec.errorf("Error updating playlist: %v", err)
+	}
+}
+
+// Saves the track's data to all sinks. Returns the track's path if one of the
+// sinks saved it on the local file system. Only fails if no sink saved the
+// track.
+func (rec *Recorder) save(info *sink.Track, data []byte) (filePath string, err error) {
+	filename := info.Filename
+	saved := false
+	for _, s := range rec.sinks {
+		if err = saveTo(s, info, data); err != nil {
+			rec.trackLog(filename).Errorf("Error saving track to %v: %v", s, err)
+			continue
+		}
+		saved = true
+		if l, ok := s.(sink.Local); ok {
+			p := l.Path(filename)
+			if filePath == "" {
+				filePath = p
+			}
+			rec.trackLog(filename).Infof("Saved track as: %v", p)
+		} else {
+			rec.trackLog(filename).Infof("Saved track to %v: %v", s, filename)
+		}
+	}
+	if !saved {
+		return "", err
+	}
+	return filePath, nil
+}
+
+func saveTo(s sink.Sink, t *sink.Track, data []byte) error {
+	w, err := s.Begin(t)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+// Saves the track, unless it's being discarded. Returns false if the track
+// should be kept around, because it has no filename yet. A track that fails
+// to save is reported and dropped.
+func (rec *Recorder) finishTrack(t *track) bool {
+	switch {
+	case t.discard:
+		rec.trackDone(t, "", "first track after connecting", nil)
+		return true
+	case t.skip:
+		rec.trackDone(t, "", t.skipReason, nil)
+		return true
+	case !t.hasFilename:
+		rec.errorf("Error: Could not get a track filename")
+		return false
+	case t.isKnown && !t.longerThanKnown():
+		rec.trackLog(t.filename).Infof("Keeping previous recording of %v, new take is not longer", t.filename)
+		rec.trackDone(t, "", "previous recording is longer", nil)
+		return true
+	}
+
+	if err := rec.checkSpace(); err != nil {
+		rec.trackLog(t.filename).Warnf("Discarding track: %v (%v)", t.filename, err)
+		rec.trackDone(t, "", "low disk space", nil)
+		// Pause recording at the next block.
+		rec.lastSpaceCheck = time.Time{}
+		return true
+	}
+
+	filename := t.filename
+	data := t.data.Bytes()
+	if t.partialReason != "" {
+		filename = rec.partialFilename(filename)
+		if rec.opts.TagPartial {
+			tagged, err := tagPartial(t.filename, data)
+			if err != nil {
+				rec.trackLog(t.filename).Warnf("Could not tag partial track %v: %v", t.filename, err)
+			} else {
+				data = tagged
+			}
+		}
+	}
+	info := &sink.Track{
+		Filename: filename,
+		Station:  rec.Station(),
+		Metadata: t.meta,
+		Start:    t.start,
+		Duration: t.duration,
+	}
+	if rec.opts.Sidecars {
+		sc, err := sidecar.Marshal(&sidecar.Sidecar{
+			Station:       rec.station,
+			URL:           rec.url,
+			Filename:      filename,
+			Artist:        t.meta.Artist,
+			Title:         t.meta.Title,
+			Album:         t.meta.Album,
+			Fields:        t.meta.Fields,
+			RawMetadata:   t.meta.Raw,
+			Start:         t.start,
+			End:           t.end,
+			Size:          len(data),
+			Duration:      t.duration.Seconds(),
+			First:         t.first,
+			Gap:           t.gap,
+			PreRoll:       t.preRoll.Seconds(),
+			PostRoll:      t.postRoll.Seconds(),
+			Partial:       t.partialReason != "",
+			DiscardReason: t.partialReason,
+		})
+		if err != nil {
+			rec.errorf("Error encoding sidecar: %v", err)
+		}
+		info.Sidecar = sc
+	}
+	filePath, err := rec.save(info, data)
+	if err != nil {
+		rec.trackDone(t, "", "", fmt.Errorf("error saving track: %w", err))
+		return true
+	}
+	t.path = filePath
+
+	// Everything else refers to the track's file in the output directory.
+	if filePath == "" {
+		rec.trackDone(t, filename, t.partialReason, nil)
+		return true
+	}
+
+	if rec.catalog != nil && t.partialReason == "" && !t.timed {
+		err := rec.catalog.Add(catalog.Entry{
+			Artist:   t.meta.Artist,
+			Title:    t.meta.Title,
+			Filename: filename,
+			Size:     t.data.Len(),
+			Duration: t.unpadded().Seconds(),
+			Recorded: time.Now(),
+		})
+		if err != nil {
+			rec.errorf("Error updating catalog: %v", err)
+		}
+	}
+
+	if rec.opts.Playlists {
+		rec.addToPlaylist(filePath, trackTitle(t), t.duration, t.start)
+	}
+
+	rec.trackDone(t, filename, t.partialReason, nil)
+	return true
+}
@@ -0,0 +1,422 @@
+// Recording of radio streams, split into individual tracks by the stream's
+// metadata (or by time), as whole shows, or as a rolling archive.
+//
+// A Recorder records a single station. It reports what it's doing through a
+// Logger and, for programs reacting to it, through events.
+package recorder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"rsr/catalog"
+	"rsr/filter"
+	"rsr/model"
+	"rsr/naming"
+	"rsr/schedule"
+	"rsr/sink"
+	"rsr/storage"
+	"rsr/vorbis"
+)
+
+var (
+	ErrNoURL           = errors.New("recorder: no stream URL")
+	ErrUnsupportedType = errors.New("recorder: content type not supported")
+	ErrGaveUp          = errors.New("recorder: giving up reconnecting")
+)
+
+// Default options.
+const (
+	DefaultReconnectDelay  = 5 * time.Second
+	DefaultPartialSuffix   = ".partial"
+	DefaultSplitEvery      = 30 * time.Minute
+	DefaultShowTemplate    = "{show} {date} {time}{ext}"
+	DefaultArchiveTemplate = "archive/{station}/{date} {time}{ext}"
+)
+
+// Receives the recorder's messages, which are meant for humans.
+type Logger interface {
+	Infof(format string, v ...interface{})
+	Warnf(format string, v ...interface{})
+	Errorf(format string, v ...interface{}) // Errors the recorder recovers from.
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+
+// Optionally implemented by a Logger to receive details only useful for
+// debugging.
+type DebugLogger interface {
+	Debugf(format string, v ...interface{})
+}
+
+// Optionally implemented by a Logger to tell messages about a track apart,
+// e.g. in structured logs. The recorder adds the field "track" (the track's
+// filename).
+type FieldLogger interface {
+	With(key string, value interface{}) Logger
+}
+
+// When and how often to try connecting again.
+type ReconnectPolicy struct {
+	Delay time.Duration // Time between attempts (default: DefaultReconnectDelay).
+	// Number of failed attempts in a row after which `Run()` gives up
+	// (0 for unlimited).
+	MaxAttempts int
+}
+
+type Options struct {
+	Name string // Station name used in messages and filenames (optional).
+	URL  string
+	Dir  string // Output directory.
+
+	Client    *http.Client // Default: http.DefaultClient.
+	Logger    Logger       // Default: no messages.
+	Reconnect ReconnectPolicy
+	// Called for everything happening to the stream and its tracks. It is
+	// called from the goroutine running `Run()` and must not block for long.
+	OnEvent func(Event)
+
+	// Recording windows. Without a schedule, the station is recorded until
+	// the context passed to `Run()` is done.
+	Schedule schedule.Schedule
+	Lead     time.Duration // Time to connect before a window starts.
+
+	// Splitting into tracks.
+	Debounce          time.Duration // Time a new ICY title has to persist.
+	PreRoll, PostRoll time.Duration // Padding around each track (not across Ogg stream boundaries).
+	SplitEvery        time.Duration // Length of tracks split by time (default: FallbackAfter or DefaultSplitEvery).
+	FallbackAfter     time.Duration // Split by time while the title doesn't change for this long (0 to only do so without metadata).
+
+	// Which tracks to save.
+	Rules     filter.Rules
+	RulesFile *filter.File     // Reloaded whenever it changes (optional).
+	Catalog   *catalog.Catalog // Saved tracks are added to it (optional).
+	// With a catalog, skip tracks already recorded, or record them again but
+	// only keep longer takes. Otherwise the catalog isn't consulted.
+	SkipExisting     bool
+	RerecordIfLonger bool
+
+	// Partial tracks, i.e. tracks missing their beginning or end.
+	KeepFirst       bool   // Save the first and last track instead of discarding them.
+	SaveInterrupted bool   // Save tracks cut off by a lost connection.
+	PartialSuffix   string // Inserted before the extension, e.g. DefaultPartialSuffix.
+	TagPartial      bool   // Add a "PARTIAL=1" tag.
+
+	// Where tracks are saved (default: a `sink.Dir` for `Dir`). Playlists and
+	// the catalog are only written for tracks saved by a `sink.Local`. Shows
+	// and the archive are always written to `Dir`.
+	Sinks []sink.Sink
+
+	// Checked before saving anything, pausing recording while the disk is
+	// low on space (optional).
+	Storage *storage.Guard
+	// Stop recording when the disk is low on space instead of pausing; `Run()`
+	// returns an error wrapping `storage.ErrLowSpace`.
+	StopOnLowSpace bool
+
+	// Additional output.
+	Sidecars  bool // JSON file with all metadata next to each track.
+	Playlists bool // M3U playlist of the tracks saved per day.
+	History   bool // Log of every title seen.
+
+	// If set, each recording window is saved as one file of the show with
+	// this name, rather than being split into tracks.
+	Show         string
+	ShowTemplate string // Default: DefaultShowTemplate.
+
+	// If set, the whole stream is also archived in segments of this length.
+	Archive         time.Duration
+	ArchiveTemplate string // Default: DefaultArchiveTemplate.
+}
+
+type EventType int
+
+const (
+	Connected          EventType = iota
+	ConnectFailed                // `Err` says why.
+	Disconnected                 // The connection was lost; `Err` says why.
+	GaveUp                       // Too many failed attempts to connect.
+	TrackStarted                 // Sent once the track's metadata is known.
+	TrackSaved                   // Also sent for shows.
+	TrackDiscarded               // `Reason` says why.
+	TrackFailed                  // Saving the track failed; `Err` says why.
+	LowDiskSpace                 // Recording pauses or stops; `Err` says why.
+	DiskSpaceRecovered           // Recording resumes after `LowDiskSpace`.
+)
+
+var eventTypeNames = [...]string{
+	Connected:          "connected",
+	ConnectFailed:      "connect_failed",
+	Disconnected:       "disconnected",
+	GaveUp:             "gave_up",
+	TrackStarted:       "track_started",
+	TrackSaved:         "track_saved",
+	TrackDiscarded:     "track_discarded",
+	TrackFailed:        "track_failed",
+	LowDiskSpace:       "low_disk_space",
+	DiskSpaceRecovered: "disk_space_recovered",
+}
+
+func (t EventType) String() string {
+	if t < 0 || int(t) >= len(eventTypeNames) {
+		return fmt.Sprintf("EventType(%d)", int(t))
+	}
+	return eventTypeNames[t]
+}
+
+// Returns the event type with the given name, e.g. "track_saved".
+func ParseEventType(name string) (EventType, bool) {
+	for t, n := range eventTypeNames {
+		if n == name {
+			return EventType(t), true
+		}
+	}
+	return 0, false
+}
+
+type Event struct {
+	Type    EventType
+	Time    time.Time
+	Station string // See `Recorder.Station()`.
+
+	// Track events only.
+	Filename string // Relative to the output directory.
+	Path     string // Where the track was saved on the local file system, if it was.
+	Metadata model.Metadata
+	Duration time.Duration
+	Size     int    // Size in bytes.
+	Reason   string // Why the track was discarded or is partial.
+
+	Err error
+}
+
+// Records a single station. The state of the track being recorded outlives
+// individual connections.
+type Recorder struct {
+	opts Options
+	log  Logger
+
+	name    string // Station name given by the user.
+	url     string
+	dir     string
+	station string // Station name sent by the server.
+	ext     string // File extension matching the stream's format.
+
+	debounce time.Duration
+	catalog  *catalog.Catalog
+	sinks    []sink.Sink
+
+	// Padding added before the start and after the end of each track.
+	preRoll, postRoll time.Duration
+	recent            *blockRing // Recent blocks for the pre-roll.
+	ending            []endingTrack
+
+	// Splitting by time, see `updateSplitMode()`.
+	splitEvery    time.Duration // Length of time based tracks.
+	fallbackAfter time.Duration // 0 to only split by time without metadata.
+	noMetadata    bool          // Whether the stream has no metadata at all.
+	timeSplit     bool          // Whether we're currently splitting by time.
+	sinceTitle    time.Duration // Time since the title last changed.
+	titled        bool          // Whether a title arrived since connecting.
+
+	headers vorbis.HeaderPages // Of the current Ogg stream.
+
+	// Whether the next metadata belongs to a new title, for the history log.
+	newTitle bool
+
+	connected bool // Whether we ever managed to connect.
+	failures  int  // Failed attempts to connect in a row.
+
+	lastSpaceCheck time.Time // See `spaceCheckEvery`.
+	lowSpace       error     // Set while recording is paused for lack of space.
+
+	statusMu sync.Mutex
+	status   Status
+	ctlMu    sync.Mutex
+	ctl      controls
+	// Set when a split was requested, until there is a boundary to split at.
+	splitRequested bool
+
+	// Set when recording whole shows instead of individual tracks.
+	show *showRecording
+	// Set when archiving the whole stream alongside the tracks.
+	archive *archiveWriter
+
+	cur *track
+	// The track during which the connection was lost. It is held until we
+	// know whether the stream resumes with the same track after reconnecting.
+	interrupted *track
+}
+
+func New(opts Options) (*Recorder, error) {
+	if opts.URL == "" {
+		return nil, ErrNoURL
+	}
+	if opts.Client == nil {
+		opts.Client = http.DefaultClient
+	}
+	if opts.Logger == nil {
+		opts.Logger = nopLogger{}
+	}
+	if opts.Reconnect.Delay <= 0 {
+		opts.Reconnect.Delay = DefaultReconnectDelay
+	}
+	if len(opts.Sinks) == 0 {
+		opts.Sinks = []sink.Sink{sink.NewDir(opts.Dir)}
+	}
+	if opts.SplitEvery <= 0 {
+		opts.SplitEvery = opts.FallbackAfter
+	}
+	if opts.SplitEvery <= 0 {
+		opts.SplitEvery = DefaultSplitEvery
+	}
+
+	rec := &Recorder{
+		opts:          opts,
+		log:           opts.Logger,
+		name:          opts.Name,
+		url:           opts.URL,
+		dir:           opts.Dir,
+		debounce:      opts.Debounce,
+		catalog:       opts.Catalog,
+		sinks:         opts.Sinks,
+		preRoll:       opts.PreRoll,
+		postRoll:      opts.PostRoll,
+		recent:        newBlockRing(opts.PreRoll),
+		splitEvery:    opts.SplitEvery,
+		fallbackAfter: opts.FallbackAfter,
+	}
+	rec.ctl.resumed = make(chan struct{}, 1)
+	rec.status.State = StateIdle
+
+	if opts.Show != "" {
+		if opts.ShowTemplate == "" {
+			opts.ShowTemplate = DefaultShowTemplate
+		}
+		tmpl, err := naming.Parse(opts.ShowTemplate, showFields...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid show template: %w", err)
+		}
+		rec.show = newShowRecording(opts.Show, tmpl)
+	}
+	if opts.Archive > 0 {
+		if opts.ArchiveTemplate == "" {
+			opts.ArchiveTemplate = DefaultArchiveTemplate
+		}
+		tmpl, err := naming.Parse(opts.ArchiveTemplate, archiveFields...)
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive template: %w", err)
+		}
+		rec.archive = newArchiveWriter(opts.Archive, tmpl)
+	}
+	return rec, nil
+}
+
+// Returns the name given in the options or, failing that, the one sent by
+// the server. May be empty.
+func (rec *Recorder) Station() string {
+	if rec.name != "" {
+		return rec.name
+	}
+	return rec.station
+}
+
+func (rec *Recorder) emit(e Event) {
+	e.Time = time.Now()
+	e.Station = rec.Station()
+	rec.updateStatus(e)
+	if rec.opts.OnEvent != nil {
+		rec.opts.OnEvent(e)
+	}
+}
+
+func (rec *Recorder) infof(f string, v ...interface{})  { rec.log.Infof(f, v...) }
+func (rec *Recorder) warnf(f string, v ...interface{})  { rec.log.Warnf(f, v...) }
+func (rec *Recorder) errorf(f string, v ...interface{}) { rec.log.Errorf(f, v...) }
+
+func (rec *Recorder) debugf(f string, v ...interface{}) {
+	if l, ok := rec.log.(DebugLogger); ok {
+		l.Debugf(f, v...)
+	}
+}
+
+// Returns the logger for messages about a track.
+func (rec *Recorder) trackLog(filename string) Logger {
+	if l, ok := rec.log.(FieldLogger); ok && filename != "" {
+		return l.With("track", filename)
+	}
+	return rec.log
+}
+
+// Records the station until `ctx` is done or, if it has a schedule, until
+// there are no more recording windows. Whatever is being recorded is saved
+// (or discarded) before returning. Errors are only returned if recording
+// can't go on, e.g. if the stream's format isn't supported.
+func (rec *Recorder) Run(ctx context.Context) error {
+	defer rec.setState(StateStopped)
+	if rec.opts.Schedule == nil {
+		if rec.show != nil {
+			rec.show.begin(time.Now())
+		}
+		err := rec.recordUntilDone(ctx)
+		rec.stop(false)
+		return err
+	}
+
+	for {
+		w, ok := rec.opts.Schedule.Next(time.Now())
+		if !ok {
+			rec.infof("No more recording windows")
+			return nil
+		}
+
+		// Connect a little early, so we don't miss the window's beginning.
+		if wait := time.Until(w.Start.Add(-rec.opts.Lead)); wait > 0 {
+			rec.infof("Next recording window: %v", w)
+			rec.setState(StateIdle)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		rec.infof("Recording window: %v", w)
+		if rec.show != nil {
+			rec.show.begin(w.Start)
+		}
+		wctx, cancel := context.WithDeadline(ctx, w.End)
+		err := rec.recordUntilDone(wctx)
+		cancel()
+
+		// Save whatever is in progress when the window closes (or the
+		// show, if a whole show is being recorded).
+		windowClosed := err == nil && ctx.Err() == nil
+		if windowClosed {
+			rec.infof("Recording window closed")
+		}
+		rec.stop(windowClosed)
+		if !windowClosed {
+			return err
+		}
+	}
+}
+
+// Records, reconnecting as needed, until `ctx` is done or an error occurs
+// that reconnecting won't fix.
+func (rec *Recorder) recordUntilDone(ctx context.Context) error {
+	for ctx.Err() == nil {
+		if err := rec.record(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
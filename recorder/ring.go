@@ -0,0 +1,57 @@
+package recorder
+
+import (
+	"time"
+)
+
+type timedBlock struct {
+	data     []byte
+	duration time.Duration
+}
+
+// Ring buffer of the most recently read blocks, holding at least `span` worth
+// of playback time (if that much has been read).
+type blockRing struct {
+	span   time.Duration
+	blocks []timedBlock
+	total  time.Duration // Sum of all block durations.
+}
+
+func newBlockRing(span time.Duration) *blockRing {
+	return &blockRing{span: span}
+}
+
+// Adds a copy of the given block, dropping the oldest blocks that are no
+// longer needed.
+func (r *blockRing) push(p []byte, d time.Duration) {
+	if r.span <= 0 {
+		return
+	}
+	r.blocks = append(r.blocks, timedBlock{
+		data:     append([]byte{}, p...),
+		duration: d,
+	})
+	r.total += d
+	for len(r.blocks) > 1 && r.total-r.blocks[0].duration >= r.span {
+		r.total -= r.blocks[0].duration
+		r.blocks[0] = timedBlock{} // Allow the data to be garbage collected.
+		r.blocks = r.blocks[1:]
+	}
+}
+
+// Returns the most recent blocks making up at least `d` of playback time,
+// oldest first.
+func (r *blockRing) last(d time.Duration) []timedBlock {
+	var sum time.Duration
+	i := len(r.blocks)
+	for i > 0 && sum < d {
+		i--
+		sum += r.blocks[i].duration
+	}
+	return r.blocks[i:]
+}
+
+func (r *blockRing) reset() {
+	r.blocks = nil
+	r.total = 0
+}
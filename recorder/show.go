@@ -0,0 +1,174 @@
+package recorder
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"rsr/history"
+	"rsr/model"
+	"rsr/naming"
+	"rsr/playlist"
+)
+
+// Placeholders allowed in show filename templates.
+var showFields = []string{"show", "station", "date", "time", "ext"}
+
+// A show being recorded into one continuous file per recording window,
+// ignoring track boundaries. The titles played during the show are listed in
+// a CUE sheet next to it.
+type showRecording struct {
+	name     string
+	template naming.Template
+	start    time.Time // Start of the recording window, used in the filename.
+
+	file     *os.File
+	filename string // Relative to the output directory.
+	path     string
+	failed   bool // Whether writing failed, so the file is incomplete.
+	duration time.Duration
+	size     int
+	cue      playlist.Cue
+
+	// Whether the title starting at `titleOffset` isn't known yet.
+	titlePending bool
+	titleOffset  time.Duration
+}
+
+func newShowRecording(name string, template naming.Template) *showRecording {
+	return &showRecording{name: name, template: template}
+}
+
+// Prepares recording a new window starting at `start`.
+func (sh *showRecording) begin(start time.Time) {
+	*sh = showRecording{name: sh.name, template: sh.template, start: start}
+}
+
+// Opens the show's file, creating any directories given by the template.
+func (rec *Recorder) openShow() error {
+	sh := rec.show
+	station := rec.Station()
+	date := sh.start.Format(naming.DateLayout)
+	filename := sh.template.Expand(map[string]string{
+		"show":    sh.name,
+		"station": station,
+		"date":    date,
+		"time":    sh.start.Format(naming.TimeLayout),
+		"ext":     rec.ext,
+	})
+	sh.filename = filename
+	sh.path = filepath.Join(rec.dir, filepath.FromSlash(filename))
+	if err := os.MkdirAll(filepath.Dir(sh.path), 0777); err != nil {
+		return err
+	}
+	f, err := os.Create(sh.path)
+	if err != nil {
+		return err
+	}
+	sh.file = f
+	sh.cue = playlist.Cue{
+		Performer: station,
+		Title:     strings.TrimSpace(sh.name + " " + date),
+		File:      filepath.Base(sh.path),
+	}
+	sh.titlePending = true
+	rec.infof("Recording show: %v", sh.path)
+	rec.emit(Event{Type: TrackStarted, Filename: filename})
+	return nil
+}
+
+// Appends a block to the show and keeps track of the titles played.
+func (rec *Recorder) appendShow(block *model.Block) {
+	sh := rec.show
+	if sh.failed {
+		return
+	}
+	if sh.file == nil {
+		if err := rec.openShow(); err != nil {
+			rec.errorf("Error creating show file: %v", err)
+			sh.failed = true
+			return
+		}
+	}
+
+	if block.Boundary {
+		sh.titlePending = true
+		sh.titleOffset = sh.duration
+	}
+	if sh.titlePending {
+		if block.Metadata != nil {
+			sh.titlePending = false
+			m := *block.Metadata
+			if rec.archive != nil {
+				rec.archiveTitle(m)
+			}
+			if rec.opts.History {
+				rec.appendHistory(history.Entry{
+					Time:        time.Now(),
+					Kind:        history.Result,
+					Station:     rec.Station(),
+					Artist:      m.Artist,
+					Title:       m.Title,
+					RawMetadata: m.Raw,
+					Saved:       true,
+					Filename:    sh.filename,
+					Reason:      "part of a show",
+				})
+			}
+			// Reconnecting usually repeats the title that was playing.
+			if n := len(sh.cue.Tracks); n == 0 ||
+				sh.cue.Tracks[n-1].Performer != m.Artist || sh.cue.Tracks[n-1].Title != m.Title {
+				sh.cue.Tracks = append(sh.cue.Tracks, playlist.CueTrack{
+					Performer: m.Artist,
+					Title:     m.Title,
+					Offset:    sh.titleOffset,
+				})
+			}
+		}
+	}
+
+	if _, err := sh.file.Write(block.Data); err != nil {
+		rec.errorf("Error writing show file: %v", err)
+		sh.failed = true
+		return
+	}
+	sh.duration += block.Duration
+	sh.size += len(block.Data)
+}
+
+// Closes the show's file and writes its CUE sheet.
+func (rec *Recorder) finishShow() {
+	sh := rec.show
+	if sh.file == nil {
+		return
+	}
+	err := sh.file.Close()
+	sh.file = nil
+	if err != nil {
+		rec.errorf("Error writing show file: %v", err)
+		sh.failed = true
+	}
+	e := Event{
+		Type:     TrackSaved,
+		Filename: sh.filename,
+		Path:     sh.path,
+		Duration: sh.duration,
+		Size:     sh.size,
+	}
+	if sh.failed {
+		rec.warnf("Show recording is incomplete: %v", sh.path)
+		e.Reason = "incomplete"
+	} else {
+		rec.infof("Saved show as: %v (%v)", sh.path, sh.duration.Round(time.Second))
+	}
+	rec.emit(e)
+	if rec.opts.Playlists {
+		rec.addToPlaylist(sh.path, sh.cue.Title, sh.duration, sh.start)
+	}
+
+	cuePath := strings.TrimSuffix(sh.path, filepath.Ext(sh.path)) + ".cue"
+	if err := sh.cue.Write(cuePath); err != nil {
+		rec.errorf("Error writing CUE sheet: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package recorder
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// How often free space is checked while recording, besides before
+	// saving each track.
+	spaceCheckEvery = 10 * time.Second
+	// How often free space is checked while recording is paused.
+	spaceRetryEvery = 30 * time.Second
+)
+
+// Checks whether there is enough free space to save anything.
+func (rec *Recorder) checkSpace() error {
+	if rec.opts.Storage == nil {
+		return nil
+	}
+	rec.lastSpaceCheck = time.Now()
+	return rec.opts.Storage.Check()
+}
+
+// Checks the free space every now and then while recording. Returns true if
+// there isn't enough anymore.
+func (rec *Recorder) spaceRanOut() bool {
+	if rec.opts.Storage == nil || time.Since(rec.lastSpaceCheck) < spaceCheckEvery {
+		return false
+	}
+	return rec.checkSpace() != nil
+}
+
+// Waits until there is enough free space to record. Returns a fatal error
+// instead if recording should stop when the disk is low on space.
+func (rec *Recorder) waitForSpace(ctx context.Context) error {
+	for {
+		err := rec.checkSpace()
+		if err == nil {
+			if rec.lowSpace != nil {
+				rec.lowSpace = nil
+				rec.infof("Enough disk space again, resuming recording")
+				rec.emit(Event{Type: DiskSpaceRecovered})
+			}
+			return nil
+		}
+		if rec.lowSpace == nil {
+			rec.lowSpace = err
+			rec.setState(StateLowSpace)
+			rec.emit(Event{Type: LowDiskSpace, Err: err})
+			if rec.opts.StopOnLowSpace {
+				return fatalError{err}
+			}
+			rec.warnf("%v, pausing recording", err)
+		}
+		select {
+		case <-time.After(spaceRetryEvery):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
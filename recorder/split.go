@@ -0,0 +1,133 @@
+package recorder
+
+import (
+	"time"
+
+	"rsr/mp3"
+	"rsr/naming"
+	"rsr/vorbis"
+)
+
+// Returns the offset in `p` at which the stream can be cut, or -1 if there is
+// no frame or page boundary in `p`.
+func (rec *Recorder) cutPoint(p []byte) int {
+	if rec.ext == ".mp3" {
+		return mp3.FrameStart(p)
+	}
+	// Blocks of Ogg streams are whole pages.
+	return 0
+}
+
+// Returns what has to be put in front of `p` for a file starting with `p` to
+// be playable, i.e. the header pages of an Ogg stream.
+func (rec *Recorder) streamHeaders(p []byte) []byte {
+	if rec.ext != ".ogg" || vorbis.IsBOS(p) {
+		return nil
+	}
+	return rec.headers.Bytes()
+}
+
+// Decides whether to split by time instead of by metadata, which is the case
+// if the stream has no metadata, if no title arrived for `splitEvery` after
+// connecting, or if the title hasn't changed for `fallbackAfter`.
+// `isBoundary` is set if the title just changed.
+func (rec *Recorder) updateSplitMode(isBoundary bool, d time.Duration) {
+	if isBoundary {
+		rec.sinceTitle = 0
+		if rec.timeSplit && !rec.noMetadata {
+			rec.timeSplit = false
+			rec.infof("Title changed, splitting by metadata again")
+		}
+		return
+	}
+	rec.sinceTitle += d
+
+	switch {
+	case rec.timeSplit:
+	case rec.noMetadata:
+		rec.timeSplit = true
+		rec.warnf("Stream has no metadata, splitting it every %v", rec.splitEvery)
+	case !rec.titled && rec.sinceTitle >= rec.splitEvery:
+		rec.timeSplit = true
+		rec.warnf("No title within %v of connecting, splitting every %v until one arrives",
+			rec.splitEvery, rec.splitEvery)
+	case rec.fallbackAfter > 0 && rec.sinceTitle >= rec.fallbackAfter:
+		rec.timeSplit = true
+		rec.infof("Title unchanged for %v, splitting every %v until it changes",
+			rec.fallbackAfter, rec.splitEvery)
+	}
+}
+
+// Names the current track after the station and the time it started, as
+// there is no usable metadata. If the connection was lost during a track
+// named the same way, the stream can't have moved on to another track, so
+// recording it continues.
+func (rec *Recorder) nameByTime() {
+	if it := rec.interrupted; it != nil {
+		rec.interrupted = nil
+		if it.timed {
+			rec.trackLog(it.filename).Infof("Resuming track after reconnecting: %v", it.filename)
+			it.gap = true
+			it.appendTrack(rec.cur)
+			rec.cur = it
+			return
+		}
+		rec.interrupted = it
+		rec.finishInterrupted()
+	}
+
+	station := rec.Station()
+	if station == "" {
+		station = "Stream"
+	}
+	now := time.Now()
+	t := rec.cur
+	// Include seconds, as tracks may be shorter than a minute.
+	t.filename = naming.Sanitize(station) + " " + now.Format(naming.DateLayout) +
+		" " + now.Format(naming.TimeLayout+"-05") + rec.ext
+	t.hasFilename = true
+	t.timed = true
+	// Any point in the stream is a track's beginning when splitting by time.
+	t.discard = false
+	t.partialReason = ""
+	rec.trackLog(t.filename).Infof("Recording track: %v", t.filename)
+	rec.trackStarted(t)
+}
+
+// Cuts the current track at the first frame or page boundary in `p` once it
+// is long enough. Returns the rest of the block, which belongs to the next
+// track.
+func (rec *Recorder) splitByTime(p []byte, d time.Duration) ([]byte, time.Duration) {
+	t := rec.cur
+	if t.len == 0 || t.duration-t.preRoll < rec.splitEvery {
+		return p, d
+	}
+	p, d, _ = rec.cut(p, d)
+	return p, d
+}
+
+// Cuts the current track at the first frame or page boundary in `p` and
+// saves it. Returns the rest of the block, which belongs to the next track,
+// and whether there was a boundary to cut at.
+func (rec *Recorder) cut(p []byte, d time.Duration) ([]byte, time.Duration, bool) {
+	t := rec.cur
+	i := rec.cutPoint(p)
+	if i < 0 {
+		return p, d, false
+	}
+
+	// Split the duration by the share of bytes going to each track.
+	d0 := d * time.Duration(i) / time.Duration(len(p))
+	t.append(p[:i], d0)
+	rec.appendPostRoll(p[:i], d0)
+	rec.recent.push(p[:i], d0)
+	p, d = p[i:], d-d0
+
+	if rec.finishTrack(t) {
+		rec.cur = new(track)
+		if hdr := rec.streamHeaders(p); len(hdr) > 0 {
+			rec.cur.append(hdr, 0)
+		}
+	}
+	return p, d, true
+}
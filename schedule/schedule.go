@@ -0,0 +1,223 @@
+// Recording schedules, made up of time windows during which a station is
+// recorded.
+//
+// Weekly rules have the format "<DAYS> <HH:MM>-<HH:MM> [<TIMEZONE>]", e.g.
+// "Sat 20:00-22:00 Europe/Berlin" or "Mon-Fri,Sun 06:00-09:30". <DAYS> is a
+// comma separated list of weekdays (Mon, Tue, ...) or ranges of weekdays, or
+// "daily". A window ending before it starts ends on the next day. Without a
+// time zone, local time is used.
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidRule = errors.New("schedule: expected '<DAYS> <HH:MM>-<HH:MM> [<TIMEZONE>]'")
+	ErrInvalidDay  = errors.New("schedule: invalid weekday")
+	ErrInvalidTime = errors.New("schedule: invalid time of day, expected '<HH:MM>'")
+)
+
+// A time window to record in. `Start` is inclusive, `End` exclusive.
+type Window struct {
+	Start time.Time
+	End   time.Time
+}
+
+func (w Window) Contains(t time.Time) bool {
+	return !t.Before(w.Start) && t.Before(w.End)
+}
+
+func (w Window) String() string {
+	const layout = "Mon 2006-01-02 15:04:05 MST"
+	return w.Start.Format(layout) + " - " + w.End.Format(layout)
+}
+
+type Schedule interface {
+	// Returns the window containing `t` or, if there is none, the next one
+	// starting after `t`. `ok` is false if there are no more windows.
+	Next(t time.Time) (w Window, ok bool)
+}
+
+// A schedule consisting of a single window, for one-off recordings.
+type Once Window
+
+func (o Once) Next(t time.Time) (Window, bool) {
+	if !t.Before(o.End) {
+		return Window{}, false
+	}
+	return Window(o), true
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	s = strings.ToLower(s)
+	if len(s) > 3 {
+		s = s[:3]
+	}
+	d, ok := weekdays[s]
+	if !ok {
+		return 0, fmt.Errorf("%w: '%v'", ErrInvalidDay, s)
+	}
+	return d, nil
+}
+
+// Parses a time of day "<HH:MM>" into minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	var h, m int
+	if _, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil ||
+		h < 0 || h > 24 || m < 0 || m > 59 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("%w: '%v'", ErrInvalidTime, s)
+	}
+	return h*60 + m, nil
+}
+
+// A weekly recurring time window.
+type Rule struct {
+	Days       [7]bool // Indexed by time.Weekday.
+	Start, End int     // Minutes since midnight.
+	Loc        *time.Location
+}
+
+func ParseRule(s string) (Rule, error) {
+	var r Rule
+	fields := strings.Fields(s)
+	if len(fields) < 2 || len(fields) > 3 {
+		return r, ErrInvalidRule
+	}
+
+	// Days.
+	if d := strings.ToLower(fields[0]); d == "daily" || d == "*" {
+		for i := range r.Days {
+			r.Days[i] = true
+		}
+	} else {
+		for _, part := range strings.Split(fields[0], ",") {
+			span := strings.SplitN(part, "-", 2)
+			from, err := parseWeekday(span[0])
+			if err != nil {
+				return r, err
+			}
+			to := from
+			if len(span) == 2 {
+				if to, err = parseWeekday(span[1]); err != nil {
+					return r, err
+				}
+			}
+			for d := from; ; d = (d + 1) % 7 {
+				r.Days[d] = true
+				if d == to {
+					break
+				}
+			}
+		}
+	}
+
+	// Time range.
+	span := strings.SplitN(fields[1], "-", 2)
+	if len(span) != 2 {
+		return r, ErrInvalidRule
+	}
+	var err error
+	if r.Start, err = parseTimeOfDay(span[0]); err != nil {
+		return r, err
+	}
+	if r.End, err = parseTimeOfDay(span[1]); err != nil {
+		return r, err
+	}
+
+	// Time zone.
+	r.Loc = time.Local
+	if len(fields) == 3 {
+		if r.Loc, err = time.LoadLocation(fields[2]); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// Length of the window in minutes.
+func (r Rule) length() int {
+	l := r.End - r.Start
+	if l <= 0 {
+		l += 24 * 60
+	}
+	return l
+}
+
+func (r Rule) Next(t time.Time) (Window, bool) {
+	lt := t.In(r.Loc)
+	// Start a day early to find a window that began yesterday and is still
+	// going on.
+	for i := -1; i <= 7; i++ {
+		day := time.Date(lt.Year(), lt.Month(), lt.Day()+i, 0, 0, 0, 0, r.Loc)
+		if !r.Days[day.Weekday()] {
+			continue
+		}
+		start := time.Date(day.Year(), day.Month(), day.Day(), 0, r.Start, 0, 0, r.Loc)
+		end := time.Date(day.Year(), day.Month(), day.Day(), 0, r.Start+r.length(), 0, 0, r.Loc)
+		if end.After(t) {
+			return Window{Start: start, End: end}, true
+		}
+	}
+	return Window{}, false
+}
+
+// Maximum length of a window merged from overlapping windows.
+const maxMerged = 7 * 24 * time.Hour
+
+// A schedule made up of weekly rules.
+type Weekly []Rule
+
+func ParseWeekly(rules []string) (Weekly, error) {
+	var ret Weekly
+	for _, s := range rules {
+		r, err := ParseRule(s)
+		if err != nil {
+			return nil, fmt.Errorf("'%v': %w", s, err)
+		}
+		ret = append(ret, r)
+	}
+	return ret, nil
+}
+
+// Returns the earliest window of all rules. Overlapping or adjacent windows
+// are merged.
+func (wk Weekly) Next(t time.Time) (Window, bool) {
+	var ret Window
+	found := false
+	for _, r := range wk {
+		if w, ok := r.Next(t); ok && (!found || w.Start.Before(ret.Start)) {
+			ret = w
+			found = true
+		}
+	}
+	if !found {
+		return ret, false
+	}
+	// Extend the window for as long as other windows overlap it (within
+	// reason, as a schedule recording around the clock never ends).
+	for extended := true; extended && ret.End.Sub(ret.Start) < maxMerged; {
+		extended = false
+		for _, r := range wk {
+			if w, ok := r.Next(ret.End); ok &&
+				!w.Start.After(ret.End) && w.End.After(ret.End) {
+				ret.End = w.End
+				extended = true
+			}
+		}
+	}
+	return ret, true
+}
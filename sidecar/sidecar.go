@@ -0,0 +1,51 @@
+// JSON sidecar files holding everything known about a recorded track.
+package sidecar
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Extension appended to the track's filename to get the sidecar's filename.
+const Ext = ".json"
+
+type Sidecar struct {
+	Station  string `json:"station,omitempty"`
+	URL      string `json:"url"`
+	Filename string `json:"filename"`
+	Artist   string `json:"artist,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Album    string `json:"album,omitempty"`
+	// All Vorbis comment fields or ICY metadata tags.
+	Fields map[string]string `json:"fields,omitempty"`
+	// The raw ICY metadata string (mp3 streams only).
+	RawMetadata string    `json:"raw_metadata,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Size        int       `json:"size"`     // Size in bytes.
+	Duration    float64   `json:"duration"` // Duration in seconds.
+	// Padding in seconds included before the track's start and after its
+	// end.
+	PreRoll  float64 `json:"pre_roll,omitempty"`
+	PostRoll float64 `json:"post_roll,omitempty"`
+	// Whether this was the first track received after connecting, which is
+	// usually incomplete.
+	First bool `json:"first"`
+	// Whether the connection was lost and resumed during the track, meaning
+	// part of it is missing.
+	Gap bool `json:"gap,omitempty"`
+	// Whether the track was cut off.
+	Partial bool `json:"partial,omitempty"`
+	// Why the track would normally have been discarded, if it was saved
+	// anyway.
+	DiscardReason string `json:"discard_reason,omitempty"`
+}
+
+// Encodes a sidecar as it is written next to the track.
+func Marshal(s *Sidecar) ([]byte, error) {
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,62 @@
+package sink
+
+import (
+	"os"
+	"path/filepath"
+
+	"rsr/sidecar"
+)
+
+// Extension of files being written, which are renamed once complete.
+const tmpExt = ".tmp"
+
+// Saves tracks as files in a directory.
+type Dir struct {
+	dir string
+}
+
+func NewDir(dir string) *Dir {
+	return &Dir{dir: dir}
+}
+
+func (d *Dir) Path(filename string) string {
+	return filepath.Join(d.dir, filename)
+}
+
+func (d *Dir) Begin(t *Track) (Writer, error) {
+	p := d.Path(t.Filename)
+	f, err := os.Create(p + tmpExt)
+	if err != nil {
+		return nil, err
+	}
+	return &dirWriter{File: f, path: p, sidecar: t.Sidecar}, nil
+}
+
+func (d *Dir) String() string {
+	return "dir " + d.dir
+}
+
+type dirWriter struct {
+	*os.File
+	path    string // Final path of the file.
+	sidecar []byte
+}
+
+func (w *dirWriter) Commit() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	if err := os.Rename(w.Name(), w.path); err != nil {
+		return err
+	}
+	if w.sidecar != nil {
+		return os.WriteFile(w.path+sidecar.Ext, w.sidecar, 0666)
+	}
+	return nil
+}
+
+func (w *dirWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.Name())
+}
@@ -0,0 +1,147 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"rsr/naming"
+)
+
+// Placeholders allowed in pipe commands.
+var pipeFields = []string{"filename", "base", "ext", "artist", "title", "station", "date"}
+
+// Maximum amount of a command's output included in errors.
+const maxPipeOutput = 4096
+
+// Tracks waiting for a pipe's command at most. Once the queue is full,
+// committing a track waits for the oldest one to be done.
+const pipeQueueSize = 16
+
+// Counts the tracks queued in all pipes, see `Wait()`.
+var pipesWG sync.WaitGroup
+
+// Pipes each track into the standard input of a new instance of a command,
+// e.g. an encoder. The command is split into arguments at whitespace, and
+// each argument may contain placeholders like in filename templates.
+//
+// Commands run in the background, one at a time and in the order tracks
+// were committed, so recording carries on while a track is encoded. Tracks
+// are kept in memory until their command is done, and failures are only
+// logged.
+type Pipe struct {
+	src  string
+	args []naming.Template
+	dir  string // Working directory.
+	log  Logger
+
+	once  sync.Once
+	queue chan pipeJob
+}
+
+type pipeJob struct {
+	filename string
+	args     []string
+	data     []byte
+}
+
+// `log` may be nil.
+func NewPipe(command, dir string, log Logger) (*Pipe, error) {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return nil, ErrNoCommand
+	}
+	if log == nil {
+		log = nopLogger{}
+	}
+	p := &Pipe{src: command, dir: dir, log: log}
+	for _, f := range fields {
+		tmpl, err := naming.Parse(f, pipeFields...)
+		if err != nil {
+			return nil, err
+		}
+		p.args = append(p.args, tmpl)
+	}
+	return p, nil
+}
+
+func (p *Pipe) Begin(t *Track) (Writer, error) {
+	vals := trackFields(t)
+	args := make([]string, len(p.args))
+	for i, a := range p.args {
+		args[i] = a.Expand(vals)
+	}
+	// Fail right away if the command can't be run at all.
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil, err
+	}
+	return &pipeWriter{p: p, job: pipeJob{filename: t.Filename, args: args}}, nil
+}
+
+func (p *Pipe) String() string {
+	return "pipe " + p.src
+}
+
+func (p *Pipe) run() {
+	for j := range p.queue {
+		if err := p.pipe(j); err != nil {
+			p.log.Errorf("Error piping %v into %v: %v", j.filename, p, err)
+		}
+		pipesWG.Done()
+	}
+}
+
+// Runs the command with the track as its input.
+func (p *Pipe) pipe(j pipeJob) error {
+	var output bytes.Buffer // Standard output and error of the command.
+	cmd := exec.Command(j.args[0], j.args[1:]...)
+	cmd.Dir = p.dir
+	cmd.Stdin = bytes.NewReader(j.data)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		out := bytes.TrimSpace(output.Bytes())
+		if len(out) > maxPipeOutput {
+			out = out[len(out)-maxPipeOutput:]
+		}
+		if len(out) == 0 {
+			return fmt.Errorf("%v: %w", cmd.Path, err)
+		}
+		return fmt.Errorf("%v: %w: %s", cmd.Path, err, out)
+	}
+	return nil
+}
+
+// Waits for the commands of all pipes to finish with the tracks committed
+// so far.
+func Wait() {
+	pipesWG.Wait()
+}
+
+type pipeWriter struct {
+	p    *Pipe
+	job  pipeJob
+	data bytes.Buffer
+}
+
+func (w *pipeWriter) Write(p []byte) (int, error) {
+	return w.data.Write(p)
+}
+
+// Queues the track for the command.
+func (w *pipeWriter) Commit() error {
+	w.p.once.Do(func() {
+		w.p.queue = make(chan pipeJob, pipeQueueSize)
+		go w.p.run()
+	})
+	w.job.data = w.data.Bytes()
+	pipesWG.Add(1)
+	w.p.queue <- w.job
+	return nil
+}
+
+func (w *pipeWriter) Abort() error {
+	return nil
+}
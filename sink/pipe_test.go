@@ -0,0 +1,68 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Collects the messages of sinks.
+type testLogger struct {
+	mu     sync.Mutex
+	errors []string
+}
+
+func (l *testLogger) Infof(string, ...interface{}) {}
+
+func (l *testLogger) Errorf(format string, v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, fmt.Sprintf(format, v...))
+}
+
+func TestPipe(t *testing.T) {
+	dir := t.TempDir()
+	p, err := NewPipe("tee {base}.out", dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveTrack(t, p, &Track{Filename: "a.mp3"}, "a")
+	saveTrack(t, p, &Track{Filename: "b.mp3"}, "b")
+	Wait()
+	for _, name := range []string{"a", "b"} {
+		data, err := os.ReadFile(filepath.Join(dir, name+".out"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != name {
+			t.Errorf("%v.out is %q", name, data)
+		}
+	}
+}
+
+// Failing commands are logged, with their output.
+func TestPipeFailure(t *testing.T) {
+	var log testLogger
+	p, err := NewPipe("ls {base}.missing", t.TempDir(), &log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saveTrack(t, p, &Track{Filename: "a.mp3"}, "a")
+	Wait()
+	if len(log.errors) != 1 || !strings.Contains(log.errors[0], "a.missing") {
+		t.Errorf("errors: %q", log.errors)
+	}
+}
+
+func TestPipeMissingCommand(t *testing.T) {
+	p, err := NewPipe("rsr-no-such-command", t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Begin(&Track{Filename: "a.mp3"}); err == nil {
+		t.Error("no error for a missing command")
+	}
+}
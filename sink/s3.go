@@ -0,0 +1,285 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"rsr/naming"
+)
+
+var (
+	ErrNoCredentials = errors.New("sink: S3 credentials missing, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	ErrNoBucket      = errors.New("sink: S3 URL has no bucket, expected 'http[s]://<HOST>/<BUCKET>[/<KEY>]'")
+)
+
+// Tracks larger than this are uploaded in parts of this size.
+const DefaultPartSize = 8 << 20
+
+// Uploads tracks to a bucket of an S3-compatible object storage, using
+// path-style URLs. Tracks are written to a local spool directory first and
+// uploaded in the background, so recording goes on while the endpoint is
+// unavailable. Whatever is left in the spool is uploaded the next time a
+// sink for the same bucket is created.
+type S3 struct {
+	endpoint *url.URL // Without the bucket.
+	bucket   string
+	key      naming.Template // Object key of a track.
+	sig      sigV4
+	client   *http.Client
+	PartSize int64 // See DefaultPartSize; at least 5 MiB for most services.
+
+	spool *spool
+}
+
+// Returns an S3 sink for `rawURL`, "http[s]://<HOST>/<BUCKET>[/<KEY>]".
+// <KEY> is a template of the object keys with the same placeholders as pipe
+// commands; if it is empty or ends with a slash, "{filename}" is appended.
+// The region may be given as the "region" query parameter (default: the
+// environment variable AWS_REGION, or "us-east-1"). Credentials are taken from
+// the environment variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+// Tracks are spooled in a subdirectory of `spoolDir`.
+func NewS3(rawURL, spoolDir string, log Logger) (*S3, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, ErrNoBucket
+	}
+	p := strings.TrimPrefix(u.Path, "/")
+	bucket := p
+	var key string
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		bucket, key = p[:i], p[i+1:]
+	}
+	if bucket == "" {
+		return nil, ErrNoBucket
+	}
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += "{filename}"
+	}
+	tmpl, err := naming.Parse(key, pipeFields...)
+	if err != nil {
+		return nil, err
+	}
+
+	region := u.Query().Get("region")
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, ErrNoCredentials
+	}
+	s := &S3{
+		endpoint: &url.URL{Scheme: u.Scheme, Host: u.Host},
+		bucket:   bucket,
+		key:      tmpl,
+		sig:      sigV4{accessKey: accessKey, secretKey: secretKey, region: region, service: "s3"},
+		client:   noRedirectClient,
+		PartSize: DefaultPartSize,
+	}
+	s.spool, err = openSpool(spoolDir, s.endpoint.String()+"/"+bucket, s, log)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *S3) String() string {
+	return "s3 " + s.endpoint.String() + "/" + s.bucket
+}
+
+func (s *S3) Begin(t *Track) (Writer, error) {
+	// Drop the empty path segments left by empty placeholders.
+	var segs []string
+	for _, seg := range strings.Split(s.key.Expand(trackFields(t)), "/") {
+		if seg != "" {
+			segs = append(segs, seg)
+		}
+	}
+	return s.spool.begin(strings.Join(segs, "/"), t.Sidecar)
+}
+
+// Returns the content type of an object.
+func contentType(key string) string {
+	switch strings.ToLower(path.Ext(key)) {
+	case ".mp3":
+		return "audio/mpeg"
+	case ".ogg":
+		return "audio/ogg"
+	case ".json":
+		return "application/json"
+	}
+	return "application/octet-stream"
+}
+
+// An error response of the endpoint.
+type s3Error struct {
+	status int
+	body   string
+}
+
+func (e *s3Error) retryable() bool { return retryStatus(e.status) }
+
+// Error codes of S3 meaning that the credentials are wrong or expired.
+var s3AuthCodes = []string{"InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken", "InvalidToken"}
+
+func (e *s3Error) authFailed() bool {
+	for _, code := range s3AuthCodes {
+		if strings.Contains(e.body, "<Code>"+code+"</Code>") {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *s3Error) Error() string {
+	if e.body == "" {
+		return fmt.Sprintf("S3 error: %v", http.StatusText(e.status))
+	}
+	return fmt.Sprintf("S3 error: %v: %v", http.StatusText(e.status), e.body)
+}
+
+// Sends a signed request for the object `key`, retrying with backoff on
+// network errors and server errors. Returns the response body.
+func (s *S3) do(method, key string, query url.Values, body []byte, hdr http.Header) (http.Header, []byte, error) {
+	u := *s.endpoint
+	u.Path = "/" + s.bucket + "/" + key
+	u.RawQuery = query.Encode()
+
+	var respHdr http.Header
+	var respBody []byte
+	err := withRetries(func() (retry bool, err error) {
+		respHdr, respBody, err = s.doOnce(method, &u, body, hdr)
+		var s3Err *s3Error
+		if errors.As(err, &s3Err) {
+			return s3Err.retryable(), err
+		}
+		return err != nil, err
+	})
+	return respHdr, respBody, err
+}
+
+func (s *S3) doOnce(method string, u *url.URL, body []byte, hdr http.Header) (http.Header, []byte, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, vs := range hdr {
+		req.Header[k] = vs
+	}
+	s.sig.sign(req, sha256Hex(body), time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Completing a multipart upload may fail after the response has begun,
+	// in which case the error is in the body of a successful response.
+	if resp.StatusCode >= 300 || bytes.Contains(respBody, []byte("<Error>")) {
+		status := resp.StatusCode
+		if status < 300 {
+			status = http.StatusInternalServerError
+		}
+		return nil, nil, &s3Error{status: status, body: strings.TrimSpace(string(respBody))}
+	}
+	return resp.Header, respBody, nil
+}
+
+// Uploads the file at `filePath` as the object `key`.
+func (s *S3) upload(key, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := http.Header{"Content-Type": {contentType(key)}}
+
+	if info.Size() <= s.PartSize {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return err
+		}
+		_, _, err = s.do("PUT", key, nil, data, hdr)
+		return err
+	}
+
+	_, body, err := s.do("POST", key, url.Values{"uploads": {""}}, nil, hdr)
+	if err != nil {
+		return err
+	}
+	var initResult struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(body, &initResult); err != nil {
+		return err
+	}
+	uploadID := initResult.UploadID
+
+	err = s.uploadParts(key, uploadID, f)
+	if err != nil {
+		// Free the parts uploaded so far.
+		s.do("DELETE", key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	}
+	return err
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+func (s *S3) uploadParts(key, uploadID string, r io.Reader) error {
+	var complete struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}
+	buf := make([]byte, s.PartSize)
+	for num := 1; ; num++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		q := url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {uploadID}}
+		respHdr, _, err := s.do("PUT", key, q, buf[:n], nil)
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: num, ETag: respHdr.Get("ETag")})
+		if n < len(buf) {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	_, _, err = s.do("POST", key, url.Values{"uploadId": {uploadID}}, body, nil)
+	return err
+}
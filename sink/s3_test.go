@@ -0,0 +1,385 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Don't wait for retries in tests.
+	retryBackoff = time.Millisecond
+}
+
+// A stand-in for an S3 endpoint, keeping objects in memory.
+type fakeS3 struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	objects  map[string][]byte         // By path, "/<BUCKET>/<KEY>".
+	uploads  map[string]map[int][]byte // Parts of multipart uploads by ID.
+	lastID   int
+	requests []string // "<METHOD> <PATH>[?<QUERY>]" of every request.
+	// If set, called before handling a request. Responds with the returned
+	// status and body instead, unless the status is 0.
+	intercept func(r *http.Request, n int) (status int, body string)
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3) {
+	f := &fakeS3{t: t, objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	u, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &S3{
+		endpoint: u,
+		bucket:   "bucket",
+		sig:      sigV4{accessKey: "AKID", secretKey: "secret", region: "us-east-1", service: "s3"},
+		client:   noRedirectClient,
+		PartSize: DefaultPartSize,
+	}
+	return f, s
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.t.Error(err)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	req := r.Method + " " + r.URL.Path
+	if r.URL.RawQuery != "" {
+		req += "?" + r.URL.RawQuery
+	}
+	f.requests = append(f.requests, req)
+
+	f.checkSignature(r, req)
+	if got, want := r.Header.Get("X-Amz-Content-Sha256"), sha256Hex(body); got != want {
+		f.t.Errorf("%v: payload hash %v, want %v", req, got, want)
+	}
+	if f.intercept != nil {
+		if status, body := f.intercept(r, len(f.requests)); status != 0 {
+			w.WriteHeader(status)
+			io.WriteString(w, body)
+			return
+		}
+	}
+
+	q := r.URL.Query()
+	has := func(key string) bool {
+		_, ok := q[key]
+		return ok
+	}
+	switch {
+	case r.Method == "POST" && has("uploads"):
+		f.lastID++
+		id := strconv.Itoa(f.lastID)
+		f.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%v</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == "PUT" && has("partNumber"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		num, _ := strconv.Atoi(q.Get("partNumber"))
+		if !ok || num < 1 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		parts[num] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%v"`, num))
+	case r.Method == "POST" && has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		var complete struct {
+			Parts []completedPart `xml:"Part"`
+		}
+		if !ok || xml.Unmarshal(body, &complete) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var obj []byte
+		for i, p := range complete.Parts {
+			if p.PartNumber != i+1 || p.ETag != fmt.Sprintf(`"etag-%v"`, i+1) {
+				f.t.Errorf("unexpected part %+v", p)
+			}
+			obj = append(obj, parts[p.PartNumber]...)
+		}
+		f.objects[r.URL.Path] = obj
+		delete(f.uploads, q.Get("uploadId"))
+		io.WriteString(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == "DELETE" && has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == "PUT":
+		if ct := r.Header.Get("Content-Type"); ct != contentType(r.URL.Path) {
+			f.t.Errorf("%v: content type %q", req, ct)
+		}
+		f.objects[r.URL.Path] = body
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// Signs the request again as received, which must result in the same
+// signature.
+func (f *fakeS3) checkSignature(r *http.Request, req string) {
+	auth := r.Header.Get("Authorization")
+	i := strings.Index(auth, "SignedHeaders=")
+	if i < 0 {
+		f.t.Errorf("%v: not signed: %q", req, auth)
+		return
+	}
+	signed := auth[i+len("SignedHeaders="):]
+	signed = signed[:strings.IndexByte(signed, ',')]
+	date, err := time.Parse(amzDateLayout, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		f.t.Errorf("%v: %v", req, err)
+		return
+	}
+
+	again, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	for _, h := range strings.Split(signed, ";") {
+		if h != "host" {
+			again.Header.Set(h, r.Header.Get(h))
+		}
+	}
+	sig := sigV4{accessKey: "AKID", secretKey: "secret", region: "us-east-1", service: "s3"}
+	sig.sign(again, r.Header.Get("X-Amz-Content-Sha256"), date)
+	if got := again.Header.Get("Authorization"); got != auth {
+		f.t.Errorf("%v: signature mismatch:\n%v\nwant:\n%v", req, auth, got)
+	}
+}
+
+// Returns the requests made so far, as recorded in `requests`.
+func (f *fakeS3) log() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeS3) object(p string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	obj, ok := f.objects[p]
+	return obj, ok
+}
+
+func writeTemp(t *testing.T, data []byte) string {
+	p := filepath.Join(t.TempDir(), "track.data")
+	if err := os.WriteFile(p, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func checkRequests(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("requests:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestS3Put(t *testing.T) {
+	f, s := newFakeS3(t)
+	data := []byte("a short track")
+	if err := s.upload("dir/A - B.mp3", writeTemp(t, data)); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, f.log(), "PUT /bucket/dir/A - B.mp3")
+	if obj, _ := f.object("/bucket/dir/A - B.mp3"); !bytes.Equal(obj, data) {
+		t.Errorf("object is %q, want %q", obj, data)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	f, s := newFakeS3(t)
+	s.PartSize = 4
+	data := []byte("0123456789")
+	if err := s.upload("track.ogg", writeTemp(t, data)); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, f.log(),
+		"POST /bucket/track.ogg?uploads=",
+		"PUT /bucket/track.ogg?partNumber=1&uploadId=1",
+		"PUT /bucket/track.ogg?partNumber=2&uploadId=1",
+		"PUT /bucket/track.ogg?partNumber=3&uploadId=1",
+		"POST /bucket/track.ogg?uploadId=1",
+	)
+	if obj, _ := f.object("/bucket/track.ogg"); !bytes.Equal(obj, data) {
+		t.Errorf("object is %q, want %q", obj, data)
+	}
+}
+
+func TestS3MultipartExactParts(t *testing.T) {
+	f, s := newFakeS3(t)
+	s.PartSize = 5
+	data := []byte("0123456789")
+	if err := s.upload("track.ogg", writeTemp(t, data)); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, f.log(),
+		"POST /bucket/track.ogg?uploads=",
+		"PUT /bucket/track.ogg?partNumber=1&uploadId=1",
+		"PUT /bucket/track.ogg?partNumber=2&uploadId=1",
+		"POST /bucket/track.ogg?uploadId=1",
+	)
+	if obj, _ := f.object("/bucket/track.ogg"); !bytes.Equal(obj, data) {
+		t.Errorf("object is %q, want %q", obj, data)
+	}
+}
+
+func TestS3MultipartAbort(t *testing.T) {
+	f, s := newFakeS3(t)
+	s.PartSize = 4
+	f.intercept = func(r *http.Request, n int) (int, string) {
+		if r.URL.Query().Get("partNumber") == "2" {
+			return http.StatusForbidden, "<Error><Code>AccessDenied</Code></Error>"
+		}
+		return 0, ""
+	}
+	err := s.upload("track.ogg", writeTemp(t, []byte("0123456789")))
+	if !permanent(err) {
+		t.Fatalf("got error %v, want a permanent one", err)
+	}
+	checkRequests(t, f.log(),
+		"POST /bucket/track.ogg?uploads=",
+		"PUT /bucket/track.ogg?partNumber=1&uploadId=1",
+		"PUT /bucket/track.ogg?partNumber=2&uploadId=1",
+		"DELETE /bucket/track.ogg?uploadId=1",
+	)
+	if _, ok := f.object("/bucket/track.ogg"); ok {
+		t.Error("object was created")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.uploads) != 0 {
+		t.Error("multipart upload wasn't aborted")
+	}
+}
+
+func TestS3Retry(t *testing.T) {
+	f, s := newFakeS3(t)
+	f.intercept = func(r *http.Request, n int) (int, string) {
+		if n == 1 {
+			return http.StatusInternalServerError, "<Error><Code>InternalError</Code></Error>"
+		}
+		return 0, ""
+	}
+	data := []byte("track")
+	if err := s.upload("track.mp3", writeTemp(t, data)); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, f.log(), "PUT /bucket/track.mp3", "PUT /bucket/track.mp3")
+	if obj, _ := f.object("/bucket/track.mp3"); !bytes.Equal(obj, data) {
+		t.Errorf("object is %q, want %q", obj, data)
+	}
+}
+
+// Refused credentials aren't the track's fault, so it isn't quarantined.
+func TestS3WrongCredentials(t *testing.T) {
+	f, s := newFakeS3(t)
+	f.intercept = func(*http.Request, int) (int, string) {
+		return http.StatusForbidden, "<Error><Code>SignatureDoesNotMatch</Code></Error>"
+	}
+	err := s.upload("track.mp3", writeTemp(t, []byte("track")))
+	if err == nil || permanent(err) {
+		t.Fatalf("got error %v, want a temporary one", err)
+	}
+	checkRequests(t, f.log(), "PUT /bucket/track.mp3")
+}
+
+func TestS3GiveUp(t *testing.T) {
+	f, s := newFakeS3(t)
+	f.intercept = func(*http.Request, int) (int, string) {
+		return http.StatusServiceUnavailable, ""
+	}
+	err := s.upload("track.mp3", writeTemp(t, []byte("track")))
+	if err == nil || permanent(err) {
+		t.Fatalf("got error %v, want a temporary one", err)
+	}
+	if n := len(f.log()); n != requestAttempts {
+		t.Errorf("made %v requests, want %v", n, requestAttempts)
+	}
+}
+
+// Completing a multipart upload may fail after the endpoint already sent
+// "200 OK".
+func TestS3ErrorInBody(t *testing.T) {
+	f, s := newFakeS3(t)
+	s.PartSize = 4
+	f.intercept = func(r *http.Request, n int) (int, string) {
+		if r.Method == "POST" && r.URL.Query().Get("uploadId") != "" && n == 4 {
+			return http.StatusOK, "<?xml version=\"1.0\"?>\n<Error><Code>InternalError</Code></Error>"
+		}
+		return 0, ""
+	}
+	data := []byte("012345")
+	if err := s.upload("track.ogg", writeTemp(t, data)); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, f.log(),
+		"POST /bucket/track.ogg?uploads=",
+		"PUT /bucket/track.ogg?partNumber=1&uploadId=1",
+		"PUT /bucket/track.ogg?partNumber=2&uploadId=1",
+		"POST /bucket/track.ogg?uploadId=1",
+		"POST /bucket/track.ogg?uploadId=1",
+	)
+	if obj, _ := f.object("/bucket/track.ogg"); !bytes.Equal(obj, data) {
+		t.Errorf("object is %q, want %q", obj, data)
+	}
+}
+
+// Polls `cond` until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+	}
+}
+
+func TestS3Sink(t *testing.T) {
+	f, direct := newFakeS3(t)
+	os.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	defer os.Unsetenv("AWS_ACCESS_KEY_ID")
+	defer os.Unsetenv("AWS_SECRET_ACCESS_KEY")
+
+	s, err := NewS3(direct.endpoint.String()+"/bucket/{station}/?region=us-east-1", t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := s.Begin(&Track{Filename: "A - B.mp3", Station: "Radio", Sidecar: []byte("{}")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "track")
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "the upload", func() bool {
+		_, ok := f.object("/bucket/Radio/A - B.mp3.json")
+		return ok
+	})
+	checkRequests(t, f.log(), "PUT /bucket/Radio/A - B.mp3", "PUT /bucket/Radio/A - B.mp3.json")
+	if obj, _ := f.object("/bucket/Radio/A - B.mp3"); string(obj) != "track" {
+		t.Errorf("object is %q", obj)
+	}
+}
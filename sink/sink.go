@@ -0,0 +1,147 @@
+// Destinations of saved tracks. A track is written to a sink in three steps:
+// it is begun, its data is written and it is either committed or aborted.
+// Until a track is committed, it must not show up anywhere as complete.
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"rsr/model"
+	"rsr/naming"
+)
+
+var (
+	ErrUnknownSink = errors.New("sink: expected 'dir', 'tar', 'null', 'pipe:<COMMAND>', 's3:<URL>' or 'webdav:<URL>'")
+	ErrNoCommand   = errors.New("sink: no command given")
+)
+
+// Name of the directory within the output directory holding tracks that
+// still need to be uploaded.
+const SpoolDir = ".rsr-spool"
+
+// A track about to be saved.
+type Track struct {
+	Filename string // E.g. "Artist - Title.mp3", without any directory.
+	Station  string // May be empty.
+	Metadata model.Metadata
+	Start    time.Time // When recording the track began.
+	Duration time.Duration
+	// The track's JSON sidecar (see package sidecar), if any. Sinks able to
+	// store more than the track itself store it along with the track.
+	Sidecar []byte
+}
+
+type Sink interface {
+	// Begins saving a track. The returned writer receives the track's data.
+	Begin(t *Track) (Writer, error)
+	String() string
+}
+
+type Writer interface {
+	io.Writer
+	// Finishes saving the track.
+	Commit() error
+	// Drops whatever was written of the track.
+	Abort() error
+}
+
+// Receives messages about what sinks do in the background.
+type Logger interface {
+	Infof(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+
+// Implemented by sinks saving tracks as files on the local file system.
+type Local interface {
+	Sink
+	// Returns where the track with the given filename is saved.
+	Path(filename string) string
+}
+
+// Parses a sink given as "dir", "tar", "null", "pipe:<COMMAND>", "s3:<URL>"
+// (see `NewS3()`) or "webdav:<URL>" (see `NewWebDAV()`). Tracks, tar archives
+// and the spool of uploads are saved in `dir`, which is also the working
+// directory of commands. `log` may be nil.
+func Parse(s, dir string, log Logger) (Sink, error) {
+	switch {
+	case s == "dir":
+		return NewDir(dir), nil
+	case s == "tar":
+		return NewTar(dir), nil
+	case s == "null":
+		return Null{}, nil
+	case strings.HasPrefix(s, "pipe:"):
+		return NewPipe(strings.TrimPrefix(s, "pipe:"), dir, log)
+	case strings.HasPrefix(s, "s3:"):
+		return NewS3(strings.TrimPrefix(s, "s3:"), filepath.Join(dir, SpoolDir), log)
+	case strings.HasPrefix(s, "webdav:"):
+		return NewWebDAV(strings.TrimPrefix(s, "webdav:"), filepath.Join(dir, SpoolDir), log)
+	}
+	return nil, fmt.Errorf("%w, but got '%v'", ErrUnknownSink, s)
+}
+
+// Returns a sink as given to `Parse()` with any password in it replaced, for
+// showing it to users.
+func Redact(s string) string {
+	// Not using `url.URL.Redacted()`, which would escape the placeholders.
+	if !strings.HasPrefix(s, "webdav:") {
+		return s
+	}
+	start := strings.Index(s, "://")
+	if start < 0 {
+		return s
+	}
+	start += len("://")
+	end := strings.IndexByte(s[start:], '/')
+	if end < 0 {
+		end = len(s) - start
+	}
+	end += start
+	at := strings.LastIndexByte(s[start:end], '@')
+	if at < 0 {
+		return s
+	}
+	at += start
+	colon := strings.IndexByte(s[start:at], ':')
+	if colon < 0 {
+		return s
+	}
+	return s[:start+colon+1] + "xxxxx" + s[at:]
+}
+
+// Returns the values of the placeholders of pipe commands and S3 keys.
+func trackFields(t *Track) map[string]string {
+	ext := path.Ext(t.Filename)
+	return map[string]string{
+		"filename": t.Filename,
+		"base":     strings.TrimSuffix(t.Filename, ext),
+		"ext":      ext,
+		"artist":   t.Metadata.Artist,
+		"title":    t.Metadata.Title,
+		"station":  t.Station,
+		"date":     t.Start.Format(naming.DateLayout),
+	}
+}
+
+// Discards all tracks, e.g. for dry runs.
+type Null struct{}
+
+func (Null) Begin(*Track) (Writer, error) { return nullWriter{}, nil }
+func (Null) String() string               { return "null" }
+
+type nullWriter struct{}
+
+func (nullWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (nullWriter) Commit() error               { return nil }
+func (nullWriter) Abort() error                { return nil }
@@ -0,0 +1,284 @@
+package sink
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"rsr/sidecar"
+)
+
+// Name of the subdirectory of a spool holding uploads that failed for good,
+// which are kept for the user to look into.
+const QuarantineDir = "quarantine"
+
+// Attempts per request, with backoff in between, which doubles after each
+// attempt.
+const requestAttempts = 4
+
+var retryBackoff = time.Second // Shortened by tests.
+
+const (
+	spoolBackoff     = 30 * time.Second // After a failed upload of the spool.
+	spoolMaxBackoff  = 10 * time.Minute
+	spoolRescanEvery = time.Hour // In case a wakeup was missed.
+)
+
+// Used for requests that are signed or carry credentials, which must not be
+// redirected.
+var noRedirectClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// Calls `f` until it succeeds, it returns an error that isn't worth
+// retrying, or it failed `requestAttempts` times, with growing pauses in
+// between.
+func withRetries(f func() (retry bool, err error)) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := f()
+		if err == nil || !retry || attempt == requestAttempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Returns whether a request that failed with an HTTP status is worth
+// retrying.
+func retryStatus(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// An error response of an endpoint, telling whether the request may succeed
+// when it's made again right away, and whether it failed because the
+// credentials were refused.
+type responseError interface {
+	error
+	retryable() bool
+	authFailed() bool
+}
+
+// Returns whether an upload failed for good, so that trying again won't
+// help. Refused credentials affect all uploads alike, so they are kept until
+// the user fixes the credentials.
+func permanent(err error) bool {
+	var respErr responseError
+	return errors.As(err, &respErr) && !respErr.retryable() && !respErr.authFailed()
+}
+
+// Uploads spooled files somewhere.
+type uploader interface {
+	upload(key, filePath string) error
+	String() string
+}
+
+// Spooled uploads are stored as two files: "<ID>.data" holding the data and
+// "<ID>.json" holding a `spoolEntry`, which is written last, so only complete
+// uploads are picked up.
+type spoolEntry struct {
+	Key string `json:"key"`
+}
+
+// Uploads in the spool are handled by one goroutine per spool directory.
+var (
+	spoolsMu sync.Mutex
+	spools   = make(map[string]*spool) // By directory.
+)
+
+type spool struct {
+	dir  string
+	up   uploader
+	log  Logger
+	wake chan struct{}
+
+	mu     sync.Mutex
+	lastID int64
+}
+
+// Returns the spool for uploads to `target` within `parent`, starting to
+// upload whatever is in it. Each target gets a spool of its own.
+func openSpool(parent, target string, up uploader, log Logger) (*spool, error) {
+	if log == nil {
+		log = nopLogger{}
+	}
+	sum := sha1.Sum([]byte(target))
+	dir := filepath.Join(parent, hex.EncodeToString(sum[:4]))
+
+	spoolsMu.Lock()
+	defer spoolsMu.Unlock()
+	if sp, ok := spools[dir]; ok {
+		return sp, nil
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	sp := &spool{dir: dir, up: up, log: log, wake: make(chan struct{}, 1)}
+	spools[dir] = sp
+	go sp.run()
+	return sp, nil
+}
+
+// Returns a new ID for an entry. IDs sort in the order entries were added.
+func (sp *spool) newID() string {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	id := time.Now().UnixNano()
+	if id <= sp.lastID {
+		id = sp.lastID + 1
+	}
+	sp.lastID = id
+	return fmt.Sprintf("%020d", id)
+}
+
+func (sp *spool) begin(key string, sidecar []byte) (Writer, error) {
+	id := sp.newID()
+	f, err := os.Create(filepath.Join(sp.dir, id+".data"))
+	if err != nil {
+		return nil, err
+	}
+	return &spoolWriter{File: f, sp: sp, id: id, key: key, sidecar: sidecar}, nil
+}
+
+// Adds an entry for data already in the spool.
+func (sp *spool) add(id, key string) error {
+	meta, err := json.Marshal(spoolEntry{Key: key})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(sp.dir, id+".json"), meta, 0666)
+}
+
+func (sp *spool) notify() {
+	select {
+	case sp.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (sp *spool) run() {
+	backoff := spoolBackoff
+	for {
+		wait := spoolRescanEvery
+		if err := sp.uploadAll(); err != nil {
+			sp.log.Errorf("Error uploading to %v, retrying in %v: %v", sp.up, backoff, err)
+			wait = backoff
+			backoff *= 2
+			if backoff > spoolMaxBackoff {
+				backoff = spoolMaxBackoff
+			}
+		} else {
+			backoff = spoolBackoff
+		}
+		select {
+		case <-sp.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Uploads all entries in the order they were added. Entries the endpoint
+// rejects for good are quarantined. Stops at any other failure, as the
+// endpoint is most likely unavailable.
+func (sp *spool) uploadAll() error {
+	names, err := filepath.Glob(filepath.Join(sp.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+	for _, metaPath := range names {
+		data, err := os.ReadFile(metaPath)
+		if err != nil {
+			return err
+		}
+		var e spoolEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			sp.log.Errorf("Dropping invalid spool entry %v: %v", metaPath, err)
+			os.Remove(metaPath)
+			continue
+		}
+		dataPath := strings.TrimSuffix(metaPath, ".json") + ".data"
+		if _, err := os.Stat(dataPath); os.IsNotExist(err) {
+			sp.log.Errorf("Dropping spool entry %v without data", metaPath)
+			os.Remove(metaPath)
+			continue
+		}
+		err = sp.up.upload(e.Key, dataPath)
+		if permanent(err) {
+			if qErr := sp.quarantine(metaPath, dataPath); qErr != nil {
+				return fmt.Errorf("%v: %v, and quarantining it failed: %w", e.Key, err, qErr)
+			}
+			sp.log.Errorf("Error uploading %v to %v, moved it to %v: %v",
+				e.Key, sp.up, filepath.Join(sp.dir, QuarantineDir), err)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("%v: %w", e.Key, err)
+		}
+		sp.log.Infof("Uploaded %v to %v", e.Key, sp.up)
+		os.Remove(dataPath)
+		os.Remove(metaPath)
+	}
+	return nil
+}
+
+// Moves an entry out of the way into the quarantine directory, data first,
+// so it's never picked up again.
+func (sp *spool) quarantine(metaPath, dataPath string) error {
+	dir := filepath.Join(sp.dir, QuarantineDir)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	if err := os.Rename(dataPath, filepath.Join(dir, filepath.Base(dataPath))); err != nil {
+		return err
+	}
+	return os.Rename(metaPath, filepath.Join(dir, filepath.Base(metaPath)))
+}
+
+type spoolWriter struct {
+	*os.File
+	sp      *spool
+	id, key string
+	sidecar []byte
+}
+
+func (w *spoolWriter) Commit() error {
+	if err := w.File.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	if err := w.sp.add(w.id, w.key); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	if w.sidecar != nil {
+		// Failing to spool the sidecar doesn't make the track any less
+		// saved.
+		id := w.sp.newID()
+		err := os.WriteFile(filepath.Join(w.sp.dir, id+".data"), w.sidecar, 0666)
+		if err == nil {
+			err = w.sp.add(id, w.key+sidecar.Ext)
+		}
+		if err != nil {
+			w.sp.log.Errorf("Error spooling sidecar of %v: %v", w.key, err)
+		}
+	}
+	w.sp.notify()
+	return nil
+}
+
+func (w *spoolWriter) Abort() error {
+	w.File.Close()
+	return os.Remove(w.Name())
+}
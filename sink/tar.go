@@ -0,0 +1,115 @@
+package sink
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"rsr/naming"
+	"rsr/sidecar"
+)
+
+// Size of the end-of-archive marker of tar files: two zero blocks.
+const tarTrailerSize = 2 * 512
+
+// Guards all tar archives, as multiple stations may share one.
+var tarMu sync.Mutex
+
+// Appends tracks to one tar archive per station and day,
+// "<STATION> <DATE>.tar", in a directory.
+type Tar struct {
+	dir string
+}
+
+func NewTar(dir string) *Tar {
+	return &Tar{dir: dir}
+}
+
+func (s *Tar) Begin(t *Track) (Writer, error) {
+	station := t.Station
+	if station == "" {
+		station = "stream"
+	}
+	name := naming.Sanitize(station) + " " + t.Start.Format(naming.DateLayout) + ".tar"
+	return &tarWriter{path: filepath.Join(s.dir, name), track: t}, nil
+}
+
+func (s *Tar) String() string {
+	return "tar " + s.dir
+}
+
+// Buffers the track, as its size has to be known before it can be added.
+type tarWriter struct {
+	path  string
+	track *Track
+	buf   bytes.Buffer
+}
+
+func (w *tarWriter) Write(p []byte) (int, error) {
+	return w.buf.Write(p)
+}
+
+func (w *tarWriter) Commit() error {
+	tarMu.Lock()
+	defer tarMu.Unlock()
+
+	f, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	// Overwrite the end-of-archive marker of an existing archive.
+	end, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if end >= tarTrailerSize {
+		end -= tarTrailerSize
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	tw := tar.NewWriter(f)
+	err = addToTar(tw, w.track, w.track.Filename, w.buf.Bytes())
+	if err == nil && w.track.Sidecar != nil {
+		err = addToTar(tw, w.track, w.track.Filename+sidecar.Ext, w.track.Sidecar)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		// Don't leave a half written entry behind.
+		if f.Truncate(end) == nil && end > 0 {
+			f.WriteAt(make([]byte, tarTrailerSize), end)
+		}
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func addToTar(tw *tar.Writer, t *Track, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0644,
+		ModTime:  t.Start.Add(t.Duration),
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func (w *tarWriter) Abort() error {
+	w.buf.Reset()
+	return nil
+}
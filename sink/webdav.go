@@ -0,0 +1,378 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"rsr/naming"
+)
+
+var (
+	ErrNoWebDAVURL = errors.New("sink: expected a WebDAV URL 'http[s]://[<USER>:<PASSWORD>@]<HOST>/<PATH>'")
+	ErrNoAuth      = errors.New("sink: WebDAV server requires an unsupported authentication scheme")
+)
+
+// Uploads tracks to a WebDAV server (e.g. Nextcloud), creating collections as
+// needed. Tracks are spooled like with `S3`.
+type WebDAV struct {
+	base   *url.URL        // Scheme and host.
+	prefix string          // Literal beginning of the path, which must exist.
+	path   naming.Template // Rest of the path of a track.
+	user   string
+	pass   string
+	client *http.Client
+
+	mu     sync.Mutex
+	basic  bool             // Whether the server asked for basic authentication.
+	digest *digestChallenge // Last digest challenge, if the server uses them.
+	nc     int              // Number of requests made with `digest`.
+
+	spool *spool
+}
+
+// Returns a WebDAV sink for `rawURL`, "http[s]://[<USER>:<PASSWORD>@]<HOST>/<PATH>".
+// <PATH> is a template of the paths of tracks with the same placeholders as
+// pipe commands; if it ends with a slash, "{filename}" is appended. Without
+// credentials in the URL, they are taken from the environment variables
+// RSR_WEBDAV_USER and RSR_WEBDAV_PASSWORD. Tracks are spooled in a
+// subdirectory of `spoolDir`.
+func NewWebDAV(rawURL, spoolDir string, log Logger) (*WebDAV, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, ErrNoWebDAVURL
+	}
+
+	p := u.Path
+	if p == "" || strings.HasSuffix(p, "/") {
+		p += "{filename}"
+	}
+	// Collections are only created below the last one not depending on the
+	// track.
+	prefix := p[:strings.LastIndexByte(p[:strings.IndexByte(p+"{", '{')], '/')+1]
+	tmpl, err := naming.Parse(strings.TrimPrefix(p, prefix), pipeFields...)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &WebDAV{
+		base:   &url.URL{Scheme: u.Scheme, Host: u.Host},
+		prefix: prefix,
+		path:   tmpl,
+		user:   os.Getenv("RSR_WEBDAV_USER"),
+		pass:   os.Getenv("RSR_WEBDAV_PASSWORD"),
+		client: noRedirectClient,
+	}
+	if u.User != nil {
+		d.user = u.User.Username()
+		d.pass, _ = u.User.Password()
+	}
+	d.spool, err = openSpool(spoolDir, d.String(), d, log)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *WebDAV) String() string {
+	return "webdav " + d.base.String() + d.prefix
+}
+
+func (d *WebDAV) Begin(t *Track) (Writer, error) {
+	var segs []string
+	for _, seg := range strings.Split(d.path.Expand(trackFields(t)), "/") {
+		if seg != "" {
+			segs = append(segs, seg)
+		}
+	}
+	return d.spool.begin(strings.Join(segs, "/"), t.Sidecar)
+}
+
+// Returns the URL of a path relative to the prefix.
+func (d *WebDAV) url(p string) string {
+	u := *d.base
+	u.Path = d.prefix + p
+	return u.String()
+}
+
+// An error response of the server.
+type webDAVError struct {
+	method string
+	status int
+}
+
+// Locked resources are unlocked eventually.
+func (e *webDAVError) retryable() bool {
+	return retryStatus(e.status) || e.status == http.StatusLocked
+}
+
+func (e *webDAVError) authFailed() bool {
+	return e.status == http.StatusUnauthorized || e.status == http.StatusForbidden
+}
+
+func (e *webDAVError) Error() string {
+	if e.authFailed() {
+		return fmt.Sprintf("WebDAV %v: %v (check the credentials)", e.method, http.StatusText(e.status))
+	}
+	return fmt.Sprintf("WebDAV %v: %v", e.method, http.StatusText(e.status))
+}
+
+func (d *WebDAV) upload(key, filePath string) error {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	err = d.do("PUT", key, data)
+	var davErr *webDAVError
+	if errors.As(err, &davErr) && davErr.status == http.StatusConflict {
+		// A collection the track goes into doesn't exist yet.
+		if err := d.makeCollections(key); err != nil {
+			return err
+		}
+		err = d.do("PUT", key, data)
+	}
+	return err
+}
+
+// Creates the collections containing `key`, from the top down.
+func (d *WebDAV) makeCollections(key string) error {
+	segs := strings.Split(key, "/")
+	for i := 1; i < len(segs); i++ {
+		err := d.do("MKCOL", strings.Join(segs[:i], "/")+"/", nil)
+		var davErr *webDAVError
+		// "Method Not Allowed" means the collection exists already.
+		if errors.As(err, &davErr) && davErr.status == http.StatusMethodNotAllowed {
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sends a request for `p`, retrying with backoff on network and server
+// errors, as well as while the resource is locked.
+func (d *WebDAV) do(method, p string, body []byte) error {
+	return withRetries(func() (bool, error) {
+		status, err := d.doOnce(method, p, body)
+		if err != nil {
+			return true, err
+		}
+		if status >= 300 {
+			davErr := &webDAVError{method: method, status: status}
+			return davErr.retryable(), davErr
+		}
+		return false, nil
+	})
+}
+
+// Sends a request, authenticating when asked to. Returns the response status.
+func (d *WebDAV) doOnce(method, p string, body []byte) (int, error) {
+	status, challenges, err := d.send(method, p, body)
+	if err != nil || status != http.StatusUnauthorized || d.user == "" {
+		return status, err
+	}
+
+	// Answer the challenge, which is kept for the following requests.
+	digest, basic := pickChallenge(challenges)
+	if digest == nil && !basic {
+		return 0, ErrNoAuth
+	}
+	d.mu.Lock()
+	if digest != nil {
+		d.digest = digest
+		d.nc = 0
+	} else {
+		d.basic, d.digest = true, nil
+	}
+	d.mu.Unlock()
+	status, _, err = d.send(method, p, body)
+	return status, err
+}
+
+// Sends a single request. Returns the response status and, if it is
+// "Unauthorized", the server's challenges.
+func (d *WebDAV) send(method, p string, body []byte) (int, []string, error) {
+	u := d.url(p)
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, err
+	}
+	if d.user != "" {
+		d.mu.Lock()
+		if d.digest != nil {
+			d.nc++
+			req.Header.Set("Authorization", d.digest.authorization(d.user, d.pass, method, req.URL.RequestURI(), d.nc))
+		} else if d.basic {
+			req.SetBasicAuth(d.user, d.pass)
+		}
+		d.mu.Unlock()
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp.Body.Close()
+
+	var challenges []string
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenges = resp.Header.Values("WWW-Authenticate")
+	}
+	return resp.StatusCode, challenges, nil
+}
+
+// Picks the challenge to answer: digest authentication with the most
+// preferred supported algorithm, or else basic authentication, if offered.
+func pickChallenge(challenges []string) (digest *digestChallenge, basic bool) {
+	for _, c := range challenges {
+		switch lower := strings.ToLower(c); {
+		case strings.HasPrefix(lower, "digest "):
+			dc := parseDigestChallenge(c[len("digest "):])
+			if dc.hash != nil && (digest == nil || dc.rank < digest.rank) {
+				digest = dc
+			}
+		case strings.HasPrefix(lower, "basic"):
+			basic = true
+		}
+	}
+	return digest, basic
+}
+
+// Digest algorithms supported, most preferred first. No algorithm means
+// MD5.
+var digestAlgorithms = []struct {
+	name string
+	sess bool // Whether the first hash covers the nonces, too.
+	hash func(string) string
+}{
+	{"SHA-256", false, sha256HexString},
+	{"SHA-256-sess", true, sha256HexString},
+	{"MD5", false, md5Hex},
+	{"MD5-sess", true, md5Hex},
+}
+
+// A challenge for HTTP digest authentication (RFC 7616), with one of
+// `digestAlgorithms`.
+type digestChallenge struct {
+	realm, nonce, opaque, algorithm string
+	qopAuth                         bool // Whether "auth" is among the offered qop values.
+
+	// Of the algorithm, nil if it isn't supported. `rank` is its index in
+	// `digestAlgorithms`.
+	hash func(string) string
+	sess bool
+	rank int
+}
+
+// Parses the parameters of a digest challenge, e.g. `realm="x", nonce="y"`.
+func parseDigestChallenge(s string) *digestChallenge {
+	params := make(map[string]string)
+	for s = strings.TrimSpace(s); s != ""; {
+		eq := strings.IndexByte(s, '=')
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimSpace(s[eq+1:])
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			// Quoted string, in which backslashes escape characters.
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			val = b.String()
+			s = strings.TrimPrefix(s[i:], `"`)
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			val = strings.TrimSpace(s[:end])
+			s = s[end:]
+		}
+		params[key] = val
+		s = strings.TrimSpace(strings.TrimPrefix(s, ","))
+	}
+
+	c := &digestChallenge{
+		realm:     params["realm"],
+		nonce:     params["nonce"],
+		opaque:    params["opaque"],
+		algorithm: params["algorithm"],
+	}
+	alg := c.algorithm
+	if alg == "" {
+		alg = "MD5"
+	}
+	for i, a := range digestAlgorithms {
+		if strings.EqualFold(a.name, alg) {
+			c.hash, c.sess, c.rank = a.hash, a.sess, i
+		}
+	}
+	for _, q := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			c.qopAuth = true
+		}
+	}
+	return c
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func sha256HexString(s string) string {
+	return sha256Hex([]byte(s))
+}
+
+// Returns the Authorization header answering the challenge. `nc` is the
+// number of requests made with the challenge's nonce, including this one.
+func (c *digestChallenge) authorization(user, pass, method, uri string, nc int) string {
+	cnonceBytes := make([]byte, 8)
+	rand.Read(cnonceBytes)
+	cnonce := hex.EncodeToString(cnonceBytes)
+	ncStr := fmt.Sprintf("%08x", nc)
+
+	ha1 := c.hash(user + ":" + c.realm + ":" + pass)
+	if c.sess {
+		ha1 = c.hash(ha1 + ":" + c.nonce + ":" + cnonce)
+	}
+	ha2 := c.hash(method + ":" + uri)
+	var response string
+	if c.qopAuth {
+		response = c.hash(ha1 + ":" + c.nonce + ":" + ncStr + ":" + cnonce + ":auth:" + ha2)
+	} else {
+		response = c.hash(ha1 + ":" + c.nonce + ":" + ha2)
+	}
+
+	h := fmt.Sprintf(`Digest username="%v", realm="%v", nonce="%v", uri="%v", response="%v"`,
+		user, c.realm, c.nonce, uri, response)
+	if c.algorithm != "" {
+		h += ", algorithm=" + c.algorithm
+	}
+	if c.opaque != "" {
+		h += fmt.Sprintf(`, opaque="%v"`, c.opaque)
+	}
+	if c.qopAuth {
+		h += fmt.Sprintf(`, qop=auth, nc=%v, cnonce="%v"`, ncStr, cnonce)
+	}
+	return h
+}
@@ -0,0 +1,426 @@
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A stand-in for a WebDAV server, keeping files in memory. Only "/dav/"
+// exists in the beginning.
+type fakeDAV struct {
+	t   *testing.T
+	url string
+
+	mu       sync.Mutex
+	files    map[string][]byte
+	cols     map[string]bool // Collections, by path with a trailing slash.
+	requests []string        // "<METHOD> <PATH>" of every request.
+
+	// Authentication required, if any: "basic" or "digest". Digest nonces
+	// go stale after `nonceUses` requests.
+	auth       string
+	user, pass string
+	nonce      int
+	nonceUses  int
+	uses       int
+	lastNC     int64
+	// Of the digest challenges offered, one each, with basic authentication
+	// offered as well unless `digestOnly` is set. Without any, a challenge
+	// without an algorithm is offered.
+	algorithms    []string
+	digestOnly    bool
+	usedAlgorithm string
+
+	down     bool   // Answer everything with "503 Service Unavailable".
+	rejected string // Path answered with "415 Unsupported Media Type".
+}
+
+func newFakeDAV(t *testing.T) *fakeDAV {
+	f := &fakeDAV{
+		t:     t,
+		files: make(map[string][]byte),
+		cols:  map[string]bool{"/": true, "/dav/": true},
+		user:  "user",
+		pass:  "secret",
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	f.url = srv.URL
+	return f
+}
+
+func (f *fakeDAV) sink(t *testing.T, rawPath string) *WebDAV {
+	u := strings.Replace(f.url, "://", "://"+f.user+":"+f.pass+"@", 1) + rawPath
+	d, err := NewWebDAV(u, t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func (f *fakeDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		f.t.Error(err)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+
+	if f.down {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if !f.authorized(w, r) {
+		return
+	}
+	if r.URL.Path == f.rejected {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+
+	p := r.URL.Path
+	parent := path.Dir(strings.TrimSuffix(p, "/")) + "/"
+	if parent == "//" {
+		parent = "/"
+	}
+	switch r.Method {
+	case "PUT":
+		if !f.cols[parent] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.files[p] = body
+		w.WriteHeader(http.StatusCreated)
+	case "MKCOL":
+		switch {
+		case f.cols[p]:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case !f.cols[parent]:
+			w.WriteHeader(http.StatusConflict)
+		default:
+			f.cols[p] = true
+			w.WriteHeader(http.StatusCreated)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+var digestParam = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+// Checks the request's credentials, asking for them if they are missing or
+// wrong.
+func (f *fakeDAV) authorized(w http.ResponseWriter, r *http.Request) bool {
+	switch f.auth {
+	case "basic":
+		if user, pass, ok := r.BasicAuth(); ok && user == f.user && pass == f.pass {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="dav"`)
+	case "digest":
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, "Digest ") {
+			params := make(map[string]string)
+			for _, m := range digestParam.FindAllStringSubmatch(auth, -1) {
+				params[m[1]] = m[2] + m[3]
+			}
+			nc, _ := strconv.ParseInt(params["nc"], 16, 64)
+			hash := md5Hex
+			if params["algorithm"] == "SHA-256" {
+				hash = sha256HexString
+			}
+			f.usedAlgorithm = params["algorithm"]
+			ha1 := hash(f.user + ":dav:" + f.pass)
+			ha2 := hash(r.Method + ":" + r.URL.RequestURI())
+			want := hash(ha1 + ":" + params["nonce"] + ":" + params["nc"] + ":" +
+				params["cnonce"] + ":auth:" + ha2)
+			current := params["nonce"] == strconv.Itoa(f.nonce)
+			if params["response"] != want || params["uri"] != r.URL.RequestURI() ||
+				params["opaque"] != "op" || params["qop"] != "auth" {
+				f.t.Errorf("%v %v: invalid digest response: %v", r.Method, r.URL.Path, auth)
+			} else if current && nc <= f.lastNC {
+				f.t.Errorf("%v %v: nonce count %v reused", r.Method, r.URL.Path, nc)
+			} else if current && f.uses < f.nonceUses {
+				f.uses++
+				f.lastNC = nc
+				return true
+			}
+		}
+		// Unknown or used up nonces are stale, so a new one is issued.
+		f.nonce++
+		f.uses, f.lastNC = 0, 0
+		stale := ""
+		if auth != "" {
+			stale = ", stale=true"
+		}
+		if !f.digestOnly {
+			w.Header().Add("WWW-Authenticate", `Basic realm="dav"`)
+		}
+		algorithms := f.algorithms
+		if len(algorithms) == 0 {
+			algorithms = []string{""}
+		}
+		for _, alg := range algorithms {
+			if alg != "" {
+				alg = ", algorithm=" + alg
+			}
+			w.Header().Add("WWW-Authenticate", fmt.Sprintf(
+				`Digest realm="dav", qop="auth,auth-int", nonce="%v", opaque="op"%v%v`, f.nonce, stale, alg))
+		}
+	default:
+		return true
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	return false
+}
+
+func (f *fakeDAV) log() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.requests...)
+}
+
+func (f *fakeDAV) file(p string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.files[p]
+	return data, ok
+}
+
+func (f *fakeDAV) set(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn()
+}
+
+func TestWebDAVCollections(t *testing.T) {
+	f := newFakeDAV(t)
+	d := f.sink(t, "/dav/{station}/{date}/")
+	if err := d.upload("Radio/2026-10-18/A - B.mp3", writeTemp(t, []byte("track"))); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, f.log(),
+		"PUT /dav/Radio/2026-10-18/A - B.mp3",
+		"MKCOL /dav/Radio/",
+		"MKCOL /dav/Radio/2026-10-18/",
+		"PUT /dav/Radio/2026-10-18/A - B.mp3",
+	)
+	if data, _ := f.file("/dav/Radio/2026-10-18/A - B.mp3"); string(data) != "track" {
+		t.Errorf("file is %q", data)
+	}
+}
+
+// "405 Method Not Allowed" means that a collection exists already.
+func TestWebDAVExistingCollection(t *testing.T) {
+	f := newFakeDAV(t)
+	f.cols["/dav/Radio/"] = true
+	d := f.sink(t, "/dav/")
+	if err := d.upload("Radio/2026-10-18/A - B.mp3", writeTemp(t, []byte("track"))); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(t, f.log(),
+		"PUT /dav/Radio/2026-10-18/A - B.mp3",
+		"MKCOL /dav/Radio/",
+		"MKCOL /dav/Radio/2026-10-18/",
+		"PUT /dav/Radio/2026-10-18/A - B.mp3",
+	)
+	if _, ok := f.file("/dav/Radio/2026-10-18/A - B.mp3"); !ok {
+		t.Error("file wasn't uploaded")
+	}
+}
+
+func TestWebDAVBasicAuth(t *testing.T) {
+	f := newFakeDAV(t)
+	f.auth = "basic"
+	d := f.sink(t, "/dav/")
+	for _, name := range []string{"a.mp3", "b.mp3"} {
+		if err := d.upload(name, writeTemp(t, []byte(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Credentials are sent right away once the server asked for them.
+	checkRequests(t, f.log(), "PUT /dav/a.mp3", "PUT /dav/a.mp3", "PUT /dav/b.mp3")
+	if data, _ := f.file("/dav/b.mp3"); string(data) != "b.mp3" {
+		t.Errorf("file is %q", data)
+	}
+}
+
+// Refused credentials keep all tracks in the spool rather than quarantining
+// them, until the credentials work.
+func TestWebDAVWrongPassword(t *testing.T) {
+	f := newFakeDAV(t)
+	f.auth = "basic"
+	f.pass = "other"
+	d := f.sink(t, "/dav/")
+	f.pass = "secret"
+	err := d.upload("a.mp3", writeTemp(t, []byte("track")))
+	if err == nil || permanent(err) {
+		t.Fatalf("got error %v, want a temporary one", err)
+	}
+
+	saveTrack(t, d, &Track{Filename: "a.mp3"}, "a")
+	saveTrack(t, d, &Track{Filename: "b.mp3"}, "b")
+	waitFor(t, "an upload to fail", func() bool {
+		return len(f.log()) >= 4
+	})
+	if n := len(spoolEntries(t, d, "")); n != 4 {
+		t.Errorf("%v files in the spool, want 4", n)
+	}
+
+	f.set(func() { f.pass = "other" })
+	d.spool.notify()
+	waitFor(t, "the spool to drain", func() bool {
+		return len(spoolEntries(t, d, "")) == 0
+	})
+	for _, name := range []string{"a", "b"} {
+		if data, _ := f.file("/dav/" + name + ".mp3"); string(data) != name {
+			t.Errorf("%v.mp3 is %q", name, data)
+		}
+	}
+}
+
+func TestWebDAVDigestAuth(t *testing.T) {
+	f := newFakeDAV(t)
+	f.auth = "digest"
+	f.nonceUses = 2
+	d := f.sink(t, "/dav/")
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		if err := d.upload(name, writeTemp(t, []byte(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkRequests(t, f.log(),
+		// Challenged, preferring digest over basic authentication.
+		"PUT /dav/a.mp3",
+		"PUT /dav/a.mp3",
+		"PUT /dav/b.mp3",
+		// The nonce went stale, so the server challenges again.
+		"PUT /dav/c.mp3",
+		"PUT /dav/c.mp3",
+	)
+	for _, name := range []string{"a.mp3", "b.mp3", "c.mp3"} {
+		if data, _ := f.file("/dav/" + name); string(data) != name {
+			t.Errorf("%v is %q", name, data)
+		}
+	}
+}
+
+// SHA-256 is preferred to MD5, and unknown algorithms are ignored.
+func TestWebDAVDigestAlgorithms(t *testing.T) {
+	f := newFakeDAV(t)
+	f.auth = "digest"
+	f.nonceUses = 10
+	f.algorithms = []string{"MD5", "SHA-512-256", "SHA-256"}
+	d := f.sink(t, "/dav/")
+	if err := d.upload("a.mp3", writeTemp(t, []byte("a"))); err != nil {
+		t.Fatal(err)
+	}
+	if f.usedAlgorithm != "SHA-256" {
+		t.Errorf("answered with algorithm %q", f.usedAlgorithm)
+	}
+}
+
+func TestWebDAVUnsupportedDigest(t *testing.T) {
+	f := newFakeDAV(t)
+	f.auth = "digest"
+	f.algorithms = []string{"SHA-512-256"}
+	f.digestOnly = true
+	d := f.sink(t, "/dav/")
+	if err := d.upload("a.mp3", writeTemp(t, []byte("a"))); !errors.Is(err, ErrNoAuth) {
+		t.Fatalf("got error %v, want %v", err, ErrNoAuth)
+	}
+}
+
+func spoolEntries(t *testing.T, d *WebDAV, dir string) []string {
+	names, err := filepath.Glob(filepath.Join(d.spool.dir, dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, n := range names {
+		names[i] = filepath.Base(n)
+	}
+	return names
+}
+
+func saveTrack(t *testing.T, s Sink, tr *Track, data string) {
+	w, err := s.Begin(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, data)
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Tracks are kept in the spool while the server is unavailable, and
+// uploaded in order once it's back.
+func TestWebDAVSpool(t *testing.T) {
+	f := newFakeDAV(t)
+	f.down = true
+	d := f.sink(t, "/dav/")
+	saveTrack(t, d, &Track{Filename: "a.mp3"}, "a")
+	saveTrack(t, d, &Track{Filename: "b.mp3"}, "b")
+
+	// The first upload is retried a few times before giving up for now.
+	waitFor(t, "the first upload to fail", func() bool {
+		return len(f.log()) >= requestAttempts
+	})
+	if n := len(spoolEntries(t, d, "")); n != 4 {
+		t.Errorf("%v files in the spool, want 4", n)
+	}
+
+	f.set(func() { f.down = false })
+	d.spool.notify()
+	waitFor(t, "the spool to drain", func() bool {
+		return len(spoolEntries(t, d, "")) == 0
+	})
+	// Nothing but the first track is tried before it's uploaded.
+	log := f.log()
+	n := len(log) - 2
+	for _, req := range log[:n] {
+		if req != "PUT /dav/a.mp3" {
+			t.Errorf("unexpected request while the server was down: %v", req)
+		}
+	}
+	checkRequests(t, log[n:], "PUT /dav/a.mp3", "PUT /dav/b.mp3")
+	for _, name := range []string{"a", "b"} {
+		if data, _ := f.file("/dav/" + name + ".mp3"); string(data) != name {
+			t.Errorf("%v.mp3 is %q", name, data)
+		}
+	}
+}
+
+// Uploads the server refuses for good are moved out of the way.
+func TestWebDAVQuarantine(t *testing.T) {
+	f := newFakeDAV(t)
+	f.rejected = "/dav/a.mp3"
+	d := f.sink(t, "/dav/")
+	saveTrack(t, d, &Track{Filename: "a.mp3", Sidecar: []byte("{}")}, "a")
+	saveTrack(t, d, &Track{Filename: "b.mp3"}, "b")
+
+	// Only the quarantine directory is left.
+	waitFor(t, "the spool to drain", func() bool {
+		names := spoolEntries(t, d, "")
+		return len(names) == 1 && names[0] == QuarantineDir
+	})
+	checkRequests(t, f.log(), "PUT /dav/a.mp3", "PUT /dav/a.mp3.json", "PUT /dav/b.mp3")
+	if n := len(spoolEntries(t, d, QuarantineDir)); n != 2 {
+		t.Errorf("%v files in quarantine, want 2", n)
+	}
+	if data, _ := f.file("/dav/b.mp3"); string(data) != "b" {
+		t.Errorf("b.mp3 is %q", data)
+	}
+}
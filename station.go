@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"rsr/catalog"
+	"rsr/logging"
+	"rsr/recorder"
+	"rsr/schedule"
+	"rsr/sink"
+	"rsr/storage"
+)
+
+// Configuration of a station, as read from the stations file. Options that
+// aren't set default to the ones given on the command line.
+type stationConfig struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	Dir  string `json:"dir,omitempty"`
+	// Weekly recording windows (see package schedule for the format). If
+	// empty, the -schedule rules apply.
+	Schedule []string `json:"schedule,omitempty"`
+	// If set, each recording window is saved as one file of the show with
+	// this name, rather than being split into tracks.
+	Show         string `json:"show,omitempty"`
+	ShowTemplate string `json:"show_template,omitempty"`
+	// If set, the whole stream is also archived in segments of this many
+	// seconds.
+	Archive         *float64 `json:"archive,omitempty"`
+	ArchiveTemplate string   `json:"archive_template,omitempty"`
+	// All times in seconds.
+	Lead     *float64 `json:"lead,omitempty"`
+	PreRoll  *float64 `json:"pre_roll,omitempty"`
+	PostRoll *float64 `json:"post_roll,omitempty"`
+	Debounce *float64 `json:"debounce,omitempty"`
+	// Splitting by time, for streams without usable metadata.
+	SplitEvery    *float64 `json:"split_every,omitempty"`
+	FallbackAfter *float64 `json:"fallback_after,omitempty"`
+	// Where to save tracks (see `sink.Parse()`).
+	Sinks []string `json:"sinks,omitempty"`
+	// Retention limits of the output directory. Stations sharing a directory
+	// should use the same limits.
+	MaxAge   *float64 `json:"max_age,omitempty"`
+	MaxSize  string   `json:"max_size,omitempty"` // See `storage.ParseSize()`.
+	MaxFiles *int     `json:"max_files,omitempty"`
+}
+
+// Returns the given number of seconds as a duration, or `def` if it's unset.
+func secondsOr(sec *float64, def time.Duration) time.Duration {
+	if sec == nil {
+		return def
+	}
+	return time.Duration(*sec * float64(time.Second))
+}
+
+func (c stationConfig) lead() time.Duration     { return secondsOr(c.Lead, scheduleLead) }
+func (c stationConfig) preRoll() time.Duration  { return secondsOr(c.PreRoll, preRoll) }
+func (c stationConfig) postRoll() time.Duration { return secondsOr(c.PostRoll, postRoll) }
+func (c stationConfig) debounce() time.Duration { return secondsOr(c.Debounce, titleDebounce) }
+
+func (c stationConfig) schedule() []string {
+	if len(c.Schedule) == 0 {
+		return scheduleRules
+	}
+	return c.Schedule
+}
+
+func (c stationConfig) fallbackAfter() time.Duration {
+	return secondsOr(c.FallbackAfter, fallbackAfter)
+}
+
+// Defaults to the time after which we fall back to splitting by time, so a
+// title that doesn't change is split at the same interval.
+func (c stationConfig) splitEvery() time.Duration {
+	d := secondsOr(c.SplitEvery, splitEvery)
+	if d == 0 {
+		d = c.fallbackAfter()
+	}
+	if d == 0 {
+		d = recorder.DefaultSplitEvery
+	}
+	return d
+}
+
+func (c stationConfig) archive() time.Duration { return secondsOr(c.Archive, archiveLength) }
+
+func (c stationConfig) retention() (storage.Retention, error) {
+	r := retention
+	r.MaxAge = secondsOr(c.MaxAge, r.MaxAge)
+	if c.MaxSize != "" {
+		size, err := storage.ParseSize(c.MaxSize)
+		if err != nil {
+			return r, err
+		}
+		r.MaxSize = size
+	}
+	if c.MaxFiles != nil {
+		r.MaxFiles = *c.MaxFiles
+	}
+	return r, nil
+}
+
+func (c stationConfig) archiveTemplate() string {
+	if c.ArchiveTemplate == "" {
+		return archiveTemplate
+	}
+	return c.ArchiveTemplate
+}
+
+func (c stationConfig) showTemplate() string {
+	if c.ShowTemplate == "" {
+		return showTemplate
+	}
+	return c.ShowTemplate
+}
+
+// Reads the stations file, which is a JSON array of station configurations.
+// Relative output directories are relative to the output directory given
+// on the command line.
+func loadStations(path, dir string) ([]stationConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var ret []stationConfig
+	if err := json.Unmarshal(data, &ret); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	names := make(map[string]bool)
+	for i := range ret {
+		c := &ret[i]
+		if c.URL == "" {
+			return nil, fmt.Errorf("%v: station %v has no URL", path, i+1)
+		}
+		if c.Name == "" {
+			c.Name = fmt.Sprintf("station%v", i+1)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("%v: duplicate station name '%v'", path, c.Name)
+		}
+		names[c.Name] = true
+		if !filepath.IsAbs(c.Dir) {
+			c.Dir = filepath.Join(dir, c.Dir)
+		}
+	}
+	return ret, nil
+}
+
+var (
+	catalogsMu sync.Mutex
+	catalogs   = make(map[string]*catalog.Catalog) // By output directory.
+)
+
+// Opens the catalog of an output directory, sharing it between all stations
+// recording into the same directory.
+func openCatalog(dir string) (*catalog.Catalog, error) {
+	catalogsMu.Lock()
+	defer catalogsMu.Unlock()
+	if c, ok := catalogs[dir]; ok {
+		return c, nil
+	}
+	c, err := catalog.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	catalogs[dir] = c
+	return c, nil
+}
+
+// Adds the station's name to messages, so they can be told apart when
+// recording multiple stations.
+type stationLogger struct {
+	*logging.Logger
+}
+
+func newStationLogger(name string) stationLogger {
+	if name == "" {
+		return stationLogger{logger}
+	}
+	return stationLogger{logger.With("station", name)}
+}
+
+// See `recorder.FieldLogger`.
+func (l stationLogger) With(key string, value interface{}) recorder.Logger {
+	return stationLogger{l.Logger.With(key, value)}
+}
+
+// Logs an error and exits.
+func (l stationLogger) fatalf(f string, v ...interface{}) {
+	l.Errorf(f, v...)
+	os.Exit(1)
+}
+
+// Returns the recorder options for the station, combining its configuration
+// with the command line options.
+func (c stationConfig) options() (recorder.Options, error) {
+	opts := recorder.Options{
+		Name:   c.Name,
+		URL:    c.URL,
+		Dir:    c.Dir,
+		Client: client,
+		Logger: newStationLogger(c.Name),
+		Reconnect: recorder.ReconnectPolicy{
+			MaxAttempts: maxReconnects,
+		},
+		OnEvent: handleEvent,
+
+		Lead:          c.lead(),
+		Debounce:      c.debounce(),
+		PreRoll:       c.preRoll(),
+		PostRoll:      c.postRoll(),
+		SplitEvery:    c.splitEvery(),
+		FallbackAfter: c.fallbackAfter(),
+
+		Rules:            filterRules,
+		RulesFile:        filterFile,
+		SkipExisting:     skipExisting,
+		RerecordIfLonger: rerecordIfLonger,
+
+		KeepFirst:       keepFirst,
+		SaveInterrupted: saveInterrupted,
+		PartialSuffix:   partialSuffix,
+		TagPartial:      tagPartialTracks,
+
+		Sidecars:  writeSidecars,
+		Playlists: writePlaylists,
+		History:   writeHistory,
+
+		Show:            c.Show,
+		ShowTemplate:    c.showTemplate(),
+		Archive:         c.archive(),
+		ArchiveTemplate: c.archiveTemplate(),
+	}
+
+	specs := c.Sinks
+	if len(specs) == 0 {
+		specs = sinkSpecs
+	}
+	for _, spec := range specs {
+		s, err := sink.Parse(spec, c.Dir, newStationLogger(c.Name))
+		if err != nil {
+			return opts, err
+		}
+		opts.Sinks = append(opts.Sinks, s)
+	}
+
+	ret, err := c.retention()
+	if err != nil {
+		return opts, err
+	}
+	if minFree > 0 || !ret.IsZero() {
+		opts.Storage = &storage.Guard{
+			Dir:       c.Dir,
+			MinFree:   minFree,
+			Retention: ret,
+			Logger:    newStationLogger(c.Name),
+		}
+		opts.StopOnLowSpace = stopOnLowSpace
+	}
+
+	if skipExisting || rerecordIfLonger {
+		cat, err := openCatalog(c.Dir)
+		if err != nil {
+			return opts, fmt.Errorf("error reading catalog: %w", err)
+		}
+		opts.Catalog = cat
+	}
+
+	if rules := c.schedule(); len(rules) > 0 {
+		sched, err := schedule.ParseWeekly(rules)
+		if err != nil {
+			return opts, fmt.Errorf("invalid schedule: %w", err)
+		}
+		opts.Schedule = sched
+	}
+	return opts, nil
+}
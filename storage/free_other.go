@@ -0,0 +1,8 @@
+//go:build !linux && !darwin && !freebsd && !windows
+// +build !linux,!darwin,!freebsd,!windows
+
+package storage
+
+func freeSpace(dir string) (uint64, error) {
+	return 0, ErrNotSupported
+}
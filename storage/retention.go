@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"rsr/sidecar"
+)
+
+// Extensions of the recordings retention limits always apply to: tracks,
+// shows and archive segments, and the archives written by the tar sink.
+var RecordingExts = []string{".mp3", ".ogg", ".tar"}
+
+// Files belonging to a recording, named after it: suffixes appended to the
+// recording's name (sidecars), and extensions replacing its own (CUE sheets
+// and the indexes of archive segments, see `recorder.ArchiveIndexExt`).
+var (
+	companionSuffixes = []string{sidecar.Ext}
+	companionExts     = []string{".cue", ".jsonl"}
+)
+
+// Recordings modified this recently may still be being written, and are
+// never deleted.
+const activeWindow = time.Minute
+
+// Limits on the recordings kept in a directory, including its
+// subdirectories. The oldest recordings are deleted first. Zero means no
+// limit.
+type Retention struct {
+	MaxAge   time.Duration
+	MaxSize  uint64 // Total size of all recordings in bytes.
+	MaxFiles int
+	// Extensions of further recordings besides `RecordingExts`, e.g.
+	// ".opus" for files encoded by a pipe sink. Lower case, with the dot.
+	Exts []string
+}
+
+func (r Retention) IsZero() bool {
+	return r.MaxAge == 0 && r.MaxSize == 0 && r.MaxFiles == 0
+}
+
+// A recording deleted to enforce the retention limits.
+type Deletion struct {
+	Path       string
+	Companions []string // Sidecar, CUE sheet etc. deleted along with it.
+	Reason     string   // Which limit was exceeded.
+}
+
+type recording struct {
+	path       string
+	modTime    time.Time
+	size       uint64 // Including the companions.
+	companions []string
+}
+
+// Deletes the oldest recordings in `dir` until all limits are met. Hidden
+// directories, such as the spool of uploads, are skipped. Returns the
+// deleted recordings, even if an error occurred.
+func (r Retention) Enforce(dir string, now time.Time) ([]Deletion, error) {
+	recs, err := r.listRecordings(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var total uint64
+	for _, rec := range recs {
+		total += rec.size
+	}
+	count := len(recs)
+
+	var deleted []Deletion
+	for _, rec := range recs {
+		var reason string
+		switch {
+		case now.Sub(rec.modTime) < activeWindow:
+			// This and all following recordings are too new.
+			return deleted, nil
+		case r.MaxAge > 0 && now.Sub(rec.modTime) > r.MaxAge:
+			reason = "older than " + FormatAge(r.MaxAge)
+		case r.MaxSize > 0 && total > r.MaxSize:
+			reason = "recordings exceed " + FormatSize(r.MaxSize)
+		case r.MaxFiles > 0 && count > r.MaxFiles:
+			reason = "more than " + strconv.Itoa(r.MaxFiles) + " recordings"
+		default:
+			return deleted, nil
+		}
+
+		if err := os.Remove(rec.path); err != nil && !os.IsNotExist(err) {
+			return deleted, err
+		}
+		d := Deletion{Path: rec.path, Reason: reason}
+		for _, c := range rec.companions {
+			if err := os.Remove(c); err != nil && !os.IsNotExist(err) {
+				return append(deleted, d), err
+			}
+			d.Companions = append(d.Companions, c)
+		}
+		deleted = append(deleted, d)
+		total -= rec.size
+		count--
+	}
+	return deleted, nil
+}
+
+// Lists all recordings in `dir`, oldest first.
+func (r Retention) listRecordings(dir string) ([]recording, error) {
+	var recs []recording
+	err := filepath.WalkDir(dir, func(p string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if e.IsDir() {
+			if p != dir && strings.HasPrefix(e.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !r.isRecording(p) {
+			return nil
+		}
+		info, err := e.Info()
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		rec := recording{path: p, modTime: info.ModTime(), size: uint64(info.Size())}
+		base := strings.TrimSuffix(p, filepath.Ext(p))
+		var candidates []string
+		for _, s := range companionSuffixes {
+			candidates = append(candidates, p+s)
+		}
+		for _, ext := range companionExts {
+			candidates = append(candidates, base+ext)
+		}
+		for _, c := range candidates {
+			if info, err := os.Stat(c); err == nil && info.Mode().IsRegular() {
+				rec.companions = append(rec.companions, c)
+				rec.size += uint64(info.Size())
+			}
+		}
+		recs = append(recs, rec)
+		return nil
+	})
+	sort.SliceStable(recs, func(i, j int) bool {
+		return recs[i].modTime.Before(recs[j].modTime)
+	})
+	return recs, err
+}
+
+func (r Retention) isRecording(p string) bool {
+	ext := strings.ToLower(filepath.Ext(p))
+	for _, exts := range [][]string{RecordingExts, r.Exts} {
+		for _, e := range exts {
+			if ext == e {
+				return true
+			}
+		}
+	}
+	return false
+}
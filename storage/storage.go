@@ -0,0 +1,164 @@
+// Keeping the output directory from filling up the disk: checking the free
+// space before saving and deleting old recordings according to retention
+// limits.
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLowSpace     = errors.New("storage: low disk space")
+	ErrNotSupported = errors.New("storage: checking free space is not supported on this system")
+	ErrInvalidSize  = errors.New("storage: expected a size like '500M' or '20G'")
+)
+
+// How often retention limits are enforced at most, since it means listing
+// the whole directory.
+const EnforceEvery = time.Minute
+
+// Returns the space available to unprivileged users on the file system
+// containing `dir`, in bytes.
+func FreeSpace(dir string) (uint64, error) {
+	return freeSpace(dir)
+}
+
+// Parses a size in bytes with an optional binary suffix, e.g. "500M" or
+// "1.5G". "B" and "iB" may be appended, as in "500MiB".
+func ParseSize(s string) (uint64, error) {
+	num := strings.ToUpper(strings.TrimSpace(s))
+	num = strings.TrimSuffix(strings.TrimSuffix(num, "B"), "I")
+	mult := uint64(1)
+	if n := len(num); n > 0 {
+		if i := strings.IndexByte("KMGT", num[n-1]); i >= 0 {
+			mult = 1 << (10 * (i + 1))
+			num = num[:n-1]
+		}
+	}
+	f, err := strconv.ParseFloat(num, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("%w, but got '%v'", ErrInvalidSize, s)
+	}
+	return uint64(f * float64(mult)), nil
+}
+
+// Formats a size in bytes for humans, e.g. "1.5 GiB".
+func FormatSize(n uint64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%v B", n)
+	}
+	f := float64(n) / 1024
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", f, units[i])
+}
+
+// Formats a duration, using days if it's a whole number of them.
+func FormatAge(d time.Duration) string {
+	const day = 24 * time.Hour
+	if d >= day && d%day == 0 {
+		return strconv.FormatInt(int64(d/day), 10) + "d"
+	}
+	return d.String()
+}
+
+// Receives the guard's messages.
+type Logger interface {
+	Infof(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+
+// Guards an output directory. It is safe for concurrent use.
+type Guard struct {
+	Dir       string
+	MinFree   uint64 // Free space needed for saving, in bytes (0 to not check).
+	Retention Retention
+	Logger    Logger // Default: no messages.
+
+	mu           sync.Mutex
+	lastEnforced time.Time
+	warned       bool // Whether we told the user free space can't be checked.
+}
+
+func (g *Guard) logger() Logger {
+	if g.Logger == nil {
+		return nopLogger{}
+	}
+	return g.Logger
+}
+
+// Enforces the retention limits, if it's time to, and checks whether there
+// is enough free space. Returns an error wrapping `ErrLowSpace` if there
+// isn't, even after deleting old recordings. Errors checking the free space
+// are only logged, since they shouldn't stop anyone from recording.
+func (g *Guard) Check() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	enforced := false
+	if !g.Retention.IsZero() && now.Sub(g.lastEnforced) >= EnforceEvery {
+		g.enforce(now)
+		enforced = true
+	}
+	if g.MinFree == 0 {
+		return nil
+	}
+
+	free, err := FreeSpace(g.Dir)
+	if err != nil {
+		if !g.warned {
+			g.logger().Errorf("Error checking free disk space: %v", err)
+			g.warned = true
+		}
+		return nil
+	}
+	if free < g.MinFree && !enforced && !g.Retention.IsZero() {
+		// Old recordings may be due for deletion by now.
+		g.enforce(now)
+		if free, err = FreeSpace(g.Dir); err != nil {
+			return nil
+		}
+	}
+	if free < g.MinFree {
+		return fmt.Errorf("%w: %v free in %v, at least %v needed", ErrLowSpace,
+			FormatSize(free), g.Dir, FormatSize(g.MinFree))
+	}
+	return nil
+}
+
+// Deletes the recordings beyond the retention limits right away.
+func (g *Guard) Enforce() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.enforce(time.Now())
+}
+
+func (g *Guard) enforce(now time.Time) {
+	g.lastEnforced = now
+	log := g.logger()
+	deleted, err := g.Retention.Enforce(g.Dir, now)
+	for _, d := range deleted {
+		log.Infof("Deleted old recording: %v (%v)", d.Path, d.Reason)
+		for _, c := range d.Companions {
+			log.Infof("Deleted: %v", c)
+		}
+	}
+	if err != nil {
+		log.Errorf("Error enforcing retention limits: %v", err)
+	}
+}
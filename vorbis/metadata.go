@@ -4,6 +4,7 @@
 package vorbis
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -88,6 +89,21 @@ func VorbisCommentDecode(r io.Reader) (VorbisComment, error) {
 	return ret, nil
 }
 
+// Encodes a Vorbis comment, the inverse of `VorbisCommentDecode()`.
+func VorbisCommentEncode(c VorbisComment) []byte {
+	var buf bytes.Buffer
+	putString := func(s string) {
+		binary.Write(&buf, binary.LittleEndian, uint32(len(s)))
+		buf.WriteString(s)
+	}
+	putString(c.Vendor)
+	binary.Write(&buf, binary.LittleEndian, uint32(len(c.Fields)))
+	for _, f := range c.Fields {
+		putString(f.Key + "=" + f.Val)
+	}
+	return buf.Bytes()
+}
+
 // Field names are searched case insensitively, as specified in the spec.
 // `found` is set to false if the field doesn't exist.
 func (c *VorbisComment) FieldByName(name string) (val string, found bool) {
@@ -110,8 +126,16 @@ var (
 	PackTypeBooks   = uint8(0x5)
 )
 
+// The fields of the identification header we're interested in.
+type VorbisInfo struct {
+	Version    uint32
+	Channels   uint8
+	SampleRate uint32
+}
+
 type VorbisHeader struct {
 	PackType uint8
+	Info     *VorbisInfo
 	Comment  *VorbisComment
 }
 
@@ -123,15 +147,34 @@ func VorbisHeaderDecode(r io.Reader) (VorbisHeader, error) {
 		return ret, err
 	}
 
-	switch ret.PackType {
-	case PackTypeComment:
+	// Both header types we decode start with the string "vorbis".
+	checkHeaderType := func() error {
 		buf := make([]byte, 6)
-		_, err = r.Read(buf)
+		_, err := r.Read(buf)
 		if err != nil {
-			return ret, err
+			return err
 		}
 		if string(buf) != "vorbis" {
-			return ret, ErrVorbisHeaderType
+			return ErrVorbisHeaderType
+		}
+		return nil
+	}
+
+	switch ret.PackType {
+	case PackTypeInfo:
+		if err := checkHeaderType(); err != nil {
+			return ret, err
+		}
+
+		var info VorbisInfo
+		err := binary.Read(r, binary.LittleEndian, &info)
+		if err != nil {
+			return ret, err
+		}
+		ret.Info = &info
+	case PackTypeComment:
+		if err := checkHeaderType(); err != nil {
+			return ret, err
 		}
 
 		comment, err := VorbisCommentDecode(r)
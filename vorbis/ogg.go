@@ -200,3 +200,94 @@ func OggDecode(r io.Reader) (OggPage, error) {
 
 	return ret, nil
 }
+
+// An undecoded page, as needed for rewriting streams.
+type rawPage struct {
+	Header OggPageHeader
+	Lacing []byte // Uncombined segment sizes.
+	Body   []byte
+}
+
+// Splits raw Ogg data into pages, without verifying any checksums.
+func splitPages(data []byte) ([]rawPage, error) {
+	var ret []rawPage
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		var p rawPage
+		err := binary.Read(r, binary.LittleEndian, &p.Header)
+		if err != nil {
+			return nil, err
+		}
+		if string(p.Header.MagicNumber[:]) != "OggS" {
+			return nil, ErrOggInvalidMagicNumber
+		}
+
+		p.Lacing = make([]byte, p.Header.NumSegments)
+		if _, err := io.ReadFull(r, p.Lacing); err != nil {
+			return nil, err
+		}
+		var size int
+		for _, v := range p.Lacing {
+			size += int(v)
+		}
+		p.Body = make([]byte, size)
+		if _, err := io.ReadFull(r, p.Body); err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, p)
+	}
+	return ret, nil
+}
+
+// Encodes the page, updating the number of segments and the checksum.
+func (p *rawPage) encode() []byte {
+	p.Header.NumSegments = uint8(len(p.Lacing))
+	p.Header.Checksum = 0
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, &p.Header) // Can't fail on a bytes.Buffer.
+	buf.Write(p.Lacing)
+	buf.Write(p.Body)
+	ret := buf.Bytes()
+
+	checksum := &crc32Writer{}
+	checksum.Write(ret)
+	p.Header.Checksum = checksum.sum
+	binary.LittleEndian.PutUint32(ret[22:26], checksum.sum)
+	return ret
+}
+
+// Returns whether the raw page `p` begins a logical stream.
+func IsBOS(p []byte) bool {
+	return len(p) >= headerSize && p[5]&FHeaderTypeBOS != 0
+}
+
+// Keeps the header pages of the current logical stream, so the stream can be
+// restarted at any later page, e.g. when cutting it into segments.
+type HeaderPages struct {
+	pages      [][]byte
+	collecting bool
+}
+
+// Feeds the next raw page of the stream. The header pages are the first page
+// of the stream and the pages after it with a granule position of 0.
+func (h *HeaderPages) Add(p []byte) {
+	if len(p) < headerSize {
+		return
+	}
+	if IsBOS(p) {
+		h.pages = nil
+		h.collecting = true
+	}
+	if h.collecting && (IsBOS(p) || binary.LittleEndian.Uint64(p[6:14]) == 0) {
+		h.pages = append(h.pages, append([]byte{}, p...))
+	} else {
+		h.collecting = false
+	}
+}
+
+// Returns all header pages.
+func (h *HeaderPages) Bytes() []byte {
+	return bytes.Join(h.pages, nil)
+}
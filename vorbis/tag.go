@@ -0,0 +1,159 @@
+package vorbis
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+var (
+	ErrNotStreamStart     = errors.New("vorbis: data doesn't start with the beginning of a stream")
+	ErrIncompleteHeaders  = errors.New("vorbis: incomplete header packets")
+	ErrMultiplexedHeaders = errors.New("vorbis: header pages of multiple streams are interleaved")
+)
+
+// Header packets have to be paginated like this, so the audio data starts on
+// a fresh page (see the Vorbis spec).
+const numHeaderPackets = 3
+
+// Splits the header packets into pages. The identification header gets a page
+// of its own, the others share as few pages as possible. `tmpl` is the header
+// of the original first page.
+func paginateHeaders(tmpl OggPageHeader, packets [][]byte) []rawPage {
+	first := rawPage{Header: tmpl}
+	first.Header.HeaderType = FHeaderTypeBOS
+	first.Header.GranulePosition = 0
+	first.Header.PageSequenceNum = 0
+	first.Lacing, first.Body = lace(packets[0])
+	ret := []rawPage{first}
+
+	var lacing, body []byte
+	for _, p := range packets[1:] {
+		l, b := lace(p)
+		lacing = append(lacing, l...)
+		body = append(body, b...)
+	}
+
+	continued := false // Whether the page continues a packet.
+	for len(lacing) > 0 {
+		n := len(lacing)
+		if n > maxSegments {
+			n = maxSegments
+		}
+		var size int
+		packetEnds := false
+		for _, v := range lacing[:n] {
+			size += int(v)
+			if v < maxSegmentSize {
+				packetEnds = true
+			}
+		}
+
+		p := rawPage{Header: tmpl}
+		p.Header.HeaderType = 0
+		if continued {
+			p.Header.HeaderType = FHeaderTypeContinuation
+		}
+		// Pages on which no packet ends have no granule position.
+		p.Header.GranulePosition = 0
+		if !packetEnds {
+			p.Header.GranulePosition = noGranulePos
+		}
+		p.Header.PageSequenceNum = uint32(len(ret))
+		p.Lacing = lacing[:n]
+		p.Body = body[:size]
+		ret = append(ret, p)
+
+		continued = lacing[n-1] == maxSegmentSize
+		lacing = lacing[n:]
+		body = body[size:]
+	}
+	return ret
+}
+
+// Returns the lacing values and body of a single packet.
+func lace(packet []byte) (lacing, body []byte) {
+	for n := len(packet); ; n -= maxSegmentSize {
+		if n < maxSegmentSize {
+			lacing = append(lacing, byte(n))
+			break
+		}
+		lacing = append(lacing, maxSegmentSize)
+	}
+	return lacing, packet
+}
+
+// Adds a field to the Vorbis comment of the first logical stream in `data`,
+// which has to start at the beginning of that stream. The header pages are
+// rewritten and the following pages of the stream renumbered accordingly.
+func AddComment(data []byte, key, val string) ([]byte, error) {
+	pages, err := splitPages(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(pages) == 0 || pages[0].Header.HeaderType&FHeaderTypeBOS == 0 {
+		return nil, ErrNotStreamStart
+	}
+	serial := pages[0].Header.BitstreamSerialNum
+
+	// Reassemble the header packets.
+	var packets [][]byte
+	var packet []byte
+	numHeaderPages := 0
+	for _, p := range pages {
+		if len(packets) == numHeaderPackets {
+			break
+		}
+		if p.Header.BitstreamSerialNum != serial {
+			return nil, ErrMultiplexedHeaders
+		}
+		off := 0
+		for _, v := range p.Lacing {
+			packet = append(packet, p.Body[off:off+int(v)]...)
+			off += int(v)
+			if v < maxSegmentSize {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+		numHeaderPages++
+	}
+	if len(packets) != numHeaderPackets {
+		return nil, ErrIncompleteHeaders
+	}
+
+	// Decode the comment header, add the field and encode it again.
+	hdr, err := VorbisHeaderDecode(bytes.NewReader(packets[1]))
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Comment == nil {
+		return nil, ErrIncompleteHeaders
+	}
+	comment := *hdr.Comment
+	comment.Fields = append(comment.Fields, VorbisCommentField{
+		Key: strings.ToUpper(key),
+		Val: val,
+	})
+	var newComment bytes.Buffer
+	newComment.WriteByte(PackTypeComment)
+	newComment.WriteString("vorbis")
+	newComment.Write(VorbisCommentEncode(comment))
+	newComment.WriteByte(1) // Framing bit.
+	packets[1] = newComment.Bytes()
+
+	newHeaderPages := paginateHeaders(pages[0].Header, packets)
+	delta := uint32(len(newHeaderPages) - numHeaderPages)
+
+	var ret bytes.Buffer
+	for i := range newHeaderPages {
+		ret.Write(newHeaderPages[i].encode())
+	}
+	for _, p := range pages[numHeaderPages:] {
+		if p.Header.BitstreamSerialNum == serial {
+			p.Header.PageSequenceNum += delta
+		}
+		ret.Write(p.encode())
+	}
+	return ret.Bytes(), nil
+}
@@ -4,8 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"io"
-	"strconv"
-	"strings"
+	"time"
+
+	"rsr/model"
 )
 
 var (
@@ -13,69 +14,86 @@ var (
 )
 
 type Extractor struct {
-	hasMetadata bool
-	metadata    *VorbisComment // Used for filename.
-	checksum    uint32         // Used for an alternate filename when there's no metadata.
+	sampleRate uint32
+	granulePos uint64 // Granule position of the last page that had one.
 }
 
+// Granule position of pages on which no packet ends (see rfc3533).
+const noGranulePos = ^uint64(0)
+
 func NewExtractor() (*Extractor, error) {
 	return new(Extractor), nil
 }
 
-func (d *Extractor) ReadBlock(reader io.Reader, w io.Writer) (isFirst bool, err error) {
+func (d *Extractor) ReadBlock(reader io.Reader) (*model.Block, error) {
 	// Everything we read here is part of the music data so we can just use a
 	// tee reader.
-	r := io.TeeReader(reader, w)
+	var data bytes.Buffer
+	r := io.TeeReader(reader, &data)
 
 	// Decode page.
 	page, err := OggDecode(r)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
 
 	// We need to be able to access `page.Segments[0]`.
 	if len(page.Segments) == 0 {
-		return false, ErrNoHeaderSegment
+		return nil, ErrNoHeaderSegment
 	}
 
-	// Decode Vorbis header, stored in `page.Segments[0]`.
-	hdr, err := VorbisHeaderDecode(bytes.NewBuffer(page.Segments[0]))
-	if err != nil {
-		return false, err
+	// Decode Vorbis header, stored in `page.Segments[0]`. If the page
+	// continues a packet from the previous page, the segment can't be the
+	// beginning of a header.
+	var hdr VorbisHeader
+	if page.Header.HeaderType&FHeaderTypeContinuation == 0 {
+		hdr, err = VorbisHeaderDecode(bytes.NewBuffer(page.Segments[0]))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block := &model.Block{
+		Data: data.Bytes(),
+		// A new logical stream is the beginning of a new file.
+		Boundary: page.Header.HeaderType&FHeaderTypeBOS > 0,
 	}
 
 	// Extract potential metadata.
 	if hdr.PackType == PackTypeComment {
-		d.hasMetadata = true
-		d.metadata = hdr.Comment
-		d.checksum = page.Header.Checksum
+		m := commentMetadata(hdr.Comment)
+		block.Metadata = &m
 	}
 
-	// Return true for isFirst if this block is the beginning of a new file.
-	return (page.Header.HeaderType & FHeaderTypeBOS) > 0, nil
-}
-
-func (d *Extractor) TryGetFilename() (filename string, hasFilename bool) {
-	if !d.hasMetadata {
-		return "", false
+	// For Vorbis, the granule position is the number of samples decoded up to
+	// the end of the page, which starts counting again with every new stream.
+	if hdr.Info != nil {
+		d.sampleRate = hdr.Info.SampleRate
 	}
-	d.hasMetadata = false
-
-	// Use relevant metadata to create a filename.
-	var base string // Filename without extension.
-	artist, artistOk := d.metadata.FieldByName("Artist")
-	title, titleOk := d.metadata.FieldByName("Title")
-	if artistOk || titleOk {
-		if !artistOk {
-			artist = "Unknown"
-		} else if !titleOk {
-			title = "Unknown"
+	if block.Boundary {
+		d.granulePos = 0
+	}
+	if gp := page.Header.GranulePosition; gp != noGranulePos && gp > d.granulePos {
+		if d.sampleRate > 0 {
+			block.Samples = int64(gp - d.granulePos)
+			block.SampleRate = int(d.sampleRate)
+			block.Duration = time.Duration(block.Samples) * time.Second / time.Duration(d.sampleRate)
 		}
-		base = artist + " -- " + title
-	} else {
-		base = "Unknown_" + strconv.FormatInt(int64(d.checksum), 10)
+		d.granulePos = gp
 	}
-	base = strings.ReplaceAll(base, "/", "_") // Replace invalid characters.
 
-	return base + ".ogg", true
+	return block, nil
+}
+
+// Returns the track metadata held by a Vorbis comment.
+func commentMetadata(c *VorbisComment) model.Metadata {
+	var m model.Metadata
+	m.Artist, _ = c.FieldByName("Artist")
+	m.Title, _ = c.FieldByName("Title")
+	m.Album, _ = c.FieldByName("Album")
+	m.Fields = make(map[string]string, len(c.Fields))
+	for _, f := range c.Fields {
+		m.Fields[f.Key] = f.Val
+	}
+	return m
 }
@@ -0,0 +1,307 @@
+// Notifying other services of recorder events by POSTing JSON to webhooks.
+//
+// Each request carries the event in its body (see `Payload`) and in the
+// "X-RSR-Event" header. With a secret, the body is signed: the
+// "X-RSR-Signature-256" header is "sha256=" followed by the hex encoded
+// HMAC-SHA256 of the body, keyed with the secret.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"rsr/recorder"
+)
+
+var ErrInvalidURL = errors.New("webhook: expected an http or https URL")
+
+// Defaults of `Webhook`.
+const (
+	DefaultQueueSize = 100
+	DefaultTimeout   = 10 * time.Second // Per request.
+)
+
+const (
+	maxAttempts = 5
+	retryDelay  = 2 * time.Second // Doubled after each failed attempt.
+)
+
+// Events sent unless others are given.
+var DefaultEvents = []recorder.EventType{
+	recorder.Connected,
+	recorder.Disconnected,
+	recorder.GaveUp,
+	recorder.TrackSaved,
+	recorder.TrackDiscarded,
+	recorder.TrackFailed,
+	recorder.LowDiskSpace,
+	recorder.DiskSpaceRecovered,
+}
+
+// Parses a comma separated list of event names, e.g.
+// "track_saved,gave_up".
+func ParseEvents(s string) ([]recorder.EventType, error) {
+	var ret []recorder.EventType
+	for _, name := range strings.Split(s, ",") {
+		t, ok := recorder.ParseEventType(strings.TrimSpace(name))
+		if !ok {
+			return nil, fmt.Errorf("webhook: unknown event '%v'", name)
+		}
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
+
+// The JSON body of a request.
+type Payload struct {
+	Event   string    `json:"event"`
+	Time    time.Time `json:"time"`
+	Station string    `json:"station,omitempty"`
+
+	// Track events only.
+	Filename string  `json:"filename,omitempty"`
+	Path     string  `json:"path,omitempty"`
+	Artist   string  `json:"artist,omitempty"`
+	Title    string  `json:"title,omitempty"`
+	Album    string  `json:"album,omitempty"`
+	Duration float64 `json:"duration,omitempty"` // In seconds.
+	Size     int     `json:"size,omitempty"`     // In bytes.
+	Reason   string  `json:"reason,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+func newPayload(e recorder.Event) Payload {
+	p := Payload{
+		Event:    e.Type.String(),
+		Time:     e.Time,
+		Station:  e.Station,
+		Filename: e.Filename,
+		Path:     e.Path,
+		Artist:   e.Metadata.Artist,
+		Title:    e.Metadata.Title,
+		Album:    e.Metadata.Album,
+		Duration: e.Duration.Seconds(),
+		Size:     e.Size,
+		Reason:   e.Reason,
+	}
+	if e.Err != nil {
+		p.Error = e.Err.Error()
+	}
+	return p
+}
+
+// Receives errors sending requests.
+type Logger interface {
+	Errorf(format string, v ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Errorf(string, ...interface{}) {}
+
+// A webhook events are sent to, one at a time and in order. Events are
+// queued, and dropped if the queue is full, so sending them never blocks.
+type Webhook struct {
+	url    string
+	secret []byte
+	events map[recorder.EventType]bool
+	client *http.Client
+	log    Logger
+
+	queue chan Payload
+	done  chan struct{} // Closed once the queue is drained after `Close()`.
+	// Canceled to give up on the events still queued.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	dropped int // Events dropped since the last message about it.
+	closed  bool
+}
+
+type Options struct {
+	Secret    string               // Key of the signatures (optional).
+	Events    []recorder.EventType // Default: DefaultEvents.
+	QueueSize int                  // Default: DefaultQueueSize.
+	Client    *http.Client         // Default: one with DefaultTimeout.
+	Logger    Logger               // Default: no messages.
+}
+
+// Returns a webhook for `rawURL` and starts sending events to it.
+func New(rawURL string, opts Options) (*Webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("%w, but got '%v'", ErrInvalidURL, rawURL)
+	}
+	if opts.Events == nil {
+		opts.Events = DefaultEvents
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: DefaultTimeout}
+	}
+	if opts.Logger == nil {
+		opts.Logger = nopLogger{}
+	}
+
+	w := &Webhook{
+		url:    rawURL,
+		events: make(map[recorder.EventType]bool),
+		client: opts.Client,
+		log:    opts.Logger,
+		queue:  make(chan Payload, opts.QueueSize),
+		done:   make(chan struct{}),
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	if opts.Secret != "" {
+		w.secret = []byte(opts.Secret)
+	}
+	for _, t := range opts.Events {
+		w.events[t] = true
+	}
+	go w.run()
+	return w, nil
+}
+
+// Returns the webhook's scheme and host, leaving out the path, which often
+// contains a token.
+func (w *Webhook) String() string {
+	u, err := url.Parse(w.url)
+	if err != nil {
+		return "webhook"
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// Queues an event, unless the webhook isn't interested in it.
+func (w *Webhook) Send(e recorder.Event) {
+	if !w.events[e.Type] {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return
+	}
+	select {
+	case w.queue <- newPayload(e):
+	default:
+		if w.dropped == 0 {
+			w.log.Errorf("Webhook %v is falling behind, dropping events", w)
+		}
+		w.dropped++
+	}
+}
+
+// Stops accepting events and waits until the queued ones are sent, or `ctx`
+// is done.
+func (w *Webhook) Close(ctx context.Context) {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		w.cancel()
+		<-w.done
+	}
+}
+
+func (w *Webhook) run() {
+	defer close(w.done)
+	for p := range w.queue {
+		w.reportDropped()
+		if err := w.deliver(p); w.ctx.Err() != nil {
+			// Given up on while closing.
+			w.mu.Lock()
+			w.dropped += 1 + len(w.queue)
+			w.mu.Unlock()
+			break
+		} else if err != nil {
+			w.log.Errorf("Error sending %v event to webhook %v: %v", p.Event, w, err)
+		}
+	}
+	w.reportDropped()
+}
+
+func (w *Webhook) reportDropped() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.dropped > 0 {
+		w.log.Errorf("Dropped %v events for webhook %v", w.dropped, w)
+		w.dropped = 0
+	}
+}
+
+// Sends a payload, retrying with backoff on network and server errors.
+func (w *Webhook) deliver(p Payload) error {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := w.post(p.Event, body)
+		if err == nil || !retry || attempt == maxAttempts {
+			return err
+		}
+		select {
+		case <-time.After(delay):
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+func (w *Webhook) post(event string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequestWithContext(w.ctx, "POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "rsr")
+	req.Header.Set("X-RSR-Event", event)
+	if w.secret != nil {
+		req.Header.Set("X-RSR-Signature-256", "sha256="+Sign(w.secret, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("HTTP %v", resp.Status)
+	}
+	return false, nil
+}
+
+// Returns the hex encoded HMAC-SHA256 of `body`, as sent in the
+// "X-RSR-Signature-256" header.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}